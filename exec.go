@@ -115,11 +115,16 @@ func commandSplitString(s string, charArray []byte) []commandSplitItem {
 	inDoubleQuote := false
 	lastOp := byte(0)
 
-	for i := range len(s) {
+	for i := 0; i < len(s); i++ {
 		ch := s[i]
 
 		// 处理引号
-		if ch == '\'' && !inDoubleQuote {
+		if ch == '\\' && !inSingleQuote && i+1 < len(s) {
+			// 转义字符原样保留, 由 ShellSplit 处理
+			currentPart.WriteByte(ch)
+			currentPart.WriteByte(s[i+1])
+			i++
+		} else if ch == '\'' && !inDoubleQuote {
 			inSingleQuote = !inSingleQuote
 			currentPart.WriteByte(ch)
 		} else if ch == '"' && !inSingleQuote {
@@ -248,8 +253,10 @@ func runCommand(config *CommandConfig, command string) (string, error) {
 		return "", fmt.Errorf("command cannot be empty")
 	}
 
-	parts := strings.Fields(commandList[0].value)
-	if len(parts) == 0 {
+	parts, err := ShellSplit(commandList[0].value)
+	if err != nil {
+		return "", err
+	} else if len(parts) == 0 {
 		return "", fmt.Errorf("command cannot be empty")
 	}
 
@@ -281,13 +288,20 @@ func runCommand(config *CommandConfig, command string) (string, error) {
 	inputFiles := []string{}
 	outputFiles := []string{}
 	for _, cmd := range commandList {
-		if cmd.op == '<' {
-			inputFiles = append(inputFiles, cmd.value)
-		} else if cmd.op == '>' {
-			outputFiles = append(outputFiles, cmd.value)
-		} else {
+		if cmd.op != '<' && cmd.op != '>' {
 			continue
 		}
+
+		words, err := ShellSplit(cmd.value)
+		if err != nil {
+			return "", err
+		} else if len(words) != 1 {
+			return "", Errorf("invalid redirection target: %q", cmd.value)
+		} else if cmd.op == '<' {
+			inputFiles = append(inputFiles, words[0])
+		} else {
+			outputFiles = append(outputFiles, words[0])
+		}
 	}
 
 	// build stdin
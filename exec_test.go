@@ -0,0 +1,75 @@
+package x
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommandSplitString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []commandSplitItem
+	}{
+		{"ls -l", []commandSplitItem{{0, "ls -l"}}},
+		{"cat a | sort", []commandSplitItem{{0, "cat a"}, {'|', "sort"}}},
+		{"echo 'a | b' | wc", []commandSplitItem{{0, "echo 'a | b'"}, {'|', "wc"}}},
+		{`echo "a | b"`, []commandSplitItem{{0, `echo "a | b"`}}},
+		{`echo a\|b`, []commandSplitItem{{0, `echo a\|b`}}},
+		{`echo "it's" | wc`, []commandSplitItem{{0, `echo "it's"`}, {'|', "wc"}}},
+	}
+
+	for _, test := range tests {
+		got := commandSplitString(test.in, []byte{'|'})
+		if len(got) != len(test.want) {
+			t.Errorf("commandSplitString(%q) = %v, want %v", test.in, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("commandSplitString(%q) = %v, want %v", test.in, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCommandEval(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "out file")
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{`printf '[%s]' 'a b' "c'd" 'x;y' ''`, "[a b][c'd][x;y][]"},
+		{`printf '[%s]' a\ b "\$HOME"`, "[a b][$HOME]"},
+		{"printf '[%s]' 'line\nbreak'", "[line\nbreak]"},
+		{`printf 'b\na\n' | sort`, "a\nb\n"},
+		{`printf '%s' 'a | b' | cat`, "a | b"},
+		{Sprintf("printf 'saved' > %s", ShellQuote(file)), "saved"},
+		{Sprintf("cat < %s", ShellQuote(file)), "saved"},
+	}
+
+	for _, test := range tests {
+		command := NewCommand(&CommandConfig{Stdout: io.Discard, Stderr: io.Discard})
+		if got, err := command.Eval("%s", test.command); err != nil {
+			t.Errorf("Eval(%q): %v", test.command, err)
+		} else if got != test.want {
+			t.Errorf("Eval(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+
+	if content, err := os.ReadFile(file); err != nil || string(content) != "saved" {
+		t.Fatalf("redirected output %q, %v", content, err)
+	}
+}
+
+func TestCommandEvalError(t *testing.T) {
+	for _, command := range []string{"", "printf 'a", "printf a > 'x y' z"} {
+		if _, err := NewCommand(&CommandConfig{Stderr: io.Discard}).Eval("%s", command); err == nil {
+			t.Errorf("Eval(%q) succeeded, want an error", command)
+		}
+	}
+}
@@ -69,6 +69,11 @@ func Fprintln(w io.Writer, a ...any) (n int, err error) {
 	return fmt.Fprintln(w, a...)
 }
 
+// Sscanf scans the argument string, storing successive space-separated values into successive arguments as determined by the format.
+func Sscanf(str string, format string, a ...any) (n int, err error) {
+	return fmt.Sscanf(str, format, a...)
+}
+
 // fmt.Println("\033[31m红色文本\033[0m")  // 红色
 // fmt.Println("\033[32m绿色文本\033[0m")  // 绿色
 // fmt.Println("\033[33m黄色文本\033[0m")  // 黄色
@@ -40,5 +40,6 @@ require (
 	github.com/gin-gonic/gin v1.10.1
 	golang.org/x/crypto v0.38.0
 	golang.org/x/exp v0.0.0-20250506013437-ce4c2cf36ca6
+	golang.org/x/term v0.32.0
 	golang.org/x/sys v0.33.0 // indirect
 )
@@ -75,6 +75,22 @@ func DoRequest(
 	body []byte,
 	timeout time.Duration,
 ) ([]byte, int, error) {
+	return doRequest(ctx, client, method, url, headers, cookies, body, timeout, nil)
+}
+
+// doRequest is DoRequest that reports the download of the response body to
+// progress when it is not nil
+func doRequest(
+	ctx context.Context,
+	client *http.Client,
+	method HttpMethod,
+	url string,
+	headers map[string]string,
+	cookies map[string]string,
+	body []byte,
+	timeout time.Duration,
+	progress TransferProgress,
+) ([]byte, int, error) {
 
 	var data io.Reader = nil
 	if body != nil {
@@ -141,20 +157,28 @@ func DoRequest(
 	// Decompressor wrappers might have their own Close methods, handled below.
 	defer resp.Body.Close()
 
+	// Count the bytes received on the wire, before decompression
+	var tracker *transferTracker
+	var respBody io.ReadCloser = resp.Body
+	if progress != nil {
+		tracker = newTransferTracker(progress, TransferDownload, url, resp.ContentLength)
+		respBody = io.NopCloser(io.TeeReader(resp.Body, tracker))
+	}
+
 	// --- Handle Response Body Decompression ---
-	var reader io.ReadCloser = resp.Body // Start with the original body by default
+	var reader io.ReadCloser = respBody // Start with the original body by default
 	var decompressErr error
 
 	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
-		reader, decompressErr = gzip.NewReader(resp.Body)
+		reader, decompressErr = gzip.NewReader(respBody)
 		if decompressErr != nil {
 			return nil, http.StatusInternalServerError, fmt.Errorf("failed to create gzip reader: %w", decompressErr)
 		}
 		// gzip.Reader implements Close, which will close the underlying resp.Body
 		defer reader.Close()
 	case "deflate":
-		reader, decompressErr = zlib.NewReader(resp.Body)
+		reader, decompressErr = zlib.NewReader(respBody)
 		if decompressErr != nil {
 			return nil, http.StatusInternalServerError, fmt.Errorf("failed to create deflate reader: %w", decompressErr)
 		}
@@ -163,12 +187,12 @@ func DoRequest(
 	case "br":
 		// brotli.NewReader returns an io.Reader, not io.ReadCloser.
 		// We still need to ensure the original resp.Body is closed via the outer defer.
-		reader = io.NopCloser(brotli.NewReader(resp.Body))
+		reader = io.NopCloser(brotli.NewReader(respBody))
 		// No defer reader.Close() needed here as NopCloser's Close does nothing,
 		// and brotli.Reader doesn't have Close(). The original resp.Body.Close() handles it.
 	case "zstd":
 		var zstdDecoder *zstd.Decoder
-		zstdDecoder, decompressErr = zstd.NewReader(resp.Body)
+		zstdDecoder, decompressErr = zstd.NewReader(respBody)
 		if decompressErr != nil {
 			return nil, http.StatusInternalServerError, fmt.Errorf("failed to create zstd reader: %w", decompressErr)
 		}
@@ -204,17 +228,30 @@ func DoRequest(
 	}
 
 	// Success
+	if tracker != nil {
+		tracker.finish()
+	}
 	return bodyBytes, resp.StatusCode, nil
 }
 
 // DownloadFile sends a GET request to the specified URL and returns the response body as a byte slice.
 func DownloadFile(ctx context.Context, urlStr string, timeout time.Duration) ([]byte, error) {
+	return DownloadFileWithProgress(ctx, urlStr, timeout, nil)
+}
+
+// DownloadFileWithProgress is DownloadFile that reports the download to
+// progress, nil reports nothing
+func DownloadFileWithProgress(
+	ctx context.Context, urlStr string, timeout time.Duration, progress TransferProgress,
+) ([]byte, error) {
 	// Create HTTP client
 	client := &http.Client{}
 	defer client.CloseIdleConnections()
 
 	// Send GET request
-	respBytes, _, err := DoRequest(context.Background(), client, HttpMethodGET, urlStr, nil, nil, nil, timeout)
+	respBytes, _, err := doRequest(
+		context.Background(), client, HttpMethodGET, urlStr, nil, nil, nil, timeout, progress,
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send GET request: %w", err)
 	}
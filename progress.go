@@ -0,0 +1,248 @@
+package x
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransferDirection tells whether a transfer sends or receives data
+type TransferDirection string
+
+const (
+	TransferUpload   TransferDirection = "upload"
+	TransferDownload TransferDirection = "download"
+)
+
+// TransferStatus is a snapshot of a running transfer
+type TransferStatus struct {
+	Direction TransferDirection
+	Name      string        // file or url being transferred
+	Done      int64         // bytes transferred so far
+	Total     int64         // total bytes, -1 when unknown
+	Speed     float64       // average bytes per second
+	ETA       time.Duration // estimated time left, 0 when unknown
+	Finished  bool
+}
+
+// Percent returns the completed percentage, 0 when the total is unknown
+func (p TransferStatus) Percent() float64 {
+	if p.Total <= 0 {
+		return Ternary(p.Finished, 100.0, 0.0)
+	}
+	return float64(p.Done) / float64(p.Total) * 100
+}
+
+// TransferProgress receives the status of transfers. OnProgress is called
+// at most 10 times per second and once more with Finished set on success.
+type TransferProgress interface {
+	OnProgress(status TransferStatus)
+}
+
+// TransferProgressFunc adapts a function to TransferProgress
+type TransferProgressFunc func(status TransferStatus)
+
+func (f TransferProgressFunc) OnProgress(status TransferStatus) {
+	f(status)
+}
+
+// NopProgress discards all progress updates
+type NopProgress struct{}
+
+func (NopProgress) OnProgress(_ TransferStatus) {}
+
+// ttyProgress draws a progress bar on the terminal
+type ttyProgress struct {
+	width int
+}
+
+// NewTTYProgress creates a TransferProgress that draws a progress bar on stdout
+func NewTTYProgress() TransferProgress {
+	return &ttyProgress{width: 30}
+}
+
+func (p *ttyProgress) OnProgress(status TransferStatus) {
+	label := Ternary(status.Direction == TransferUpload, "Uploading", "Downloading")
+
+	filled := int(status.Percent() / 100 * float64(p.width))
+	filled = Max(0, Min(filled, p.width))
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", p.width-filled)
+
+	line := Sprintf(
+		"\r%s: [%s] %6.2f%% %s %s/s",
+		label, bar, status.Percent(),
+		formatTransferSize(status.Done, status.Total), formatBytes(int64(status.Speed)),
+	)
+
+	if status.Finished {
+		ColorPrintf("green", "%s - Finished!\033[K\n", line)
+	} else if status.ETA > 0 {
+		ColorPrintf("cyan", "%s ETA %s\033[K", line, status.ETA.Round(time.Second))
+	} else {
+		ColorPrintf("cyan", "%s\033[K", line)
+	}
+}
+
+// logProgress writes a log line per interval
+type logProgress struct {
+	interval time.Duration
+	last     map[string]time.Time
+	mu       *sync.Mutex
+}
+
+// NewLogProgress creates a TransferProgress that logs the status of every
+// transfer at most once per interval and once when it finishes
+func NewLogProgress(interval time.Duration) TransferProgress {
+	return &logProgress{
+		interval: interval,
+		last:     map[string]time.Time{},
+		mu:       &sync.Mutex{},
+	}
+}
+
+func (p *logProgress) OnProgress(status TransferStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if status.Finished {
+		delete(p.last, status.Name)
+		LogInfof(
+			"%s %s finished: %s in %s/s",
+			status.Direction, status.Name,
+			formatBytes(status.Done), formatBytes(int64(status.Speed)),
+		)
+	} else if last, ok := p.last[status.Name]; !ok || time.Since(last) >= p.interval {
+		p.last[status.Name] = time.Now()
+		LogInfof(
+			"%s %s: %.2f%% %s %s/s ETA %s",
+			status.Direction, status.Name, status.Percent(),
+			formatTransferSize(status.Done, status.Total), formatBytes(int64(status.Speed)),
+			Ternary(status.ETA > 0, status.ETA.Round(time.Second).String(), "unknown"),
+		)
+	} else {
+		Ignore()
+	}
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return Sprintf("%dB", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatTransferSize(done int64, total int64) string {
+	if total < 0 {
+		return formatBytes(done)
+	}
+	return Sprintf("%s/%s", formatBytes(done), formatBytes(total))
+}
+
+// transferTracker counts the bytes written to it and reports them to a
+// TransferProgress with speed and ETA
+type transferTracker struct {
+	progress   TransferProgress
+	status     TransferStatus
+	offset     int64 // bytes done before the tracker started
+	start      time.Time
+	lastUpdate time.Time
+}
+
+func newTransferTracker(
+	progress TransferProgress, direction TransferDirection, name string, total int64,
+) *transferTracker {
+	return &transferTracker{
+		progress: progress,
+		status: TransferStatus{
+			Direction: direction,
+			Name:      name,
+			Total:     total,
+		},
+		start: time.Now(),
+	}
+}
+
+// resume starts counting at offset for transfers that continue a previous one
+func (p *transferTracker) resume(offset int64) {
+	p.offset = offset
+	p.status.Done = offset
+}
+
+func (p *transferTracker) Write(data []byte) (int, error) {
+	p.status.Done += int64(len(data))
+
+	// Update progress at most 10 times per second to avoid flooding the output
+	if time.Since(p.lastUpdate) > 100*time.Millisecond {
+		p.report()
+		p.lastUpdate = time.Now()
+	}
+
+	return len(data), nil
+}
+
+func (p *transferTracker) report() {
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		p.status.Speed = float64(p.status.Done-p.offset) / elapsed
+	}
+
+	if p.status.Speed > 0 && p.status.Total > p.status.Done {
+		p.status.ETA = time.Duration(float64(p.status.Total-p.status.Done) / p.status.Speed * float64(time.Second))
+	} else {
+		p.status.ETA = 0
+	}
+
+	p.progress.OnProgress(p.status)
+}
+
+// finish reports the final status of a successful transfer
+func (p *transferTracker) finish() {
+	p.status.Finished = true
+	p.report()
+}
+
+// transferIdle stops a transfer that made no progress for timeout, every
+// write to it is progress. Slow transfers run as long as data moves.
+type transferIdle struct {
+	timer   *time.Timer
+	timeout time.Duration
+	expired atomic.Bool
+}
+
+// newTransferIdle calls stop once no data was written for timeout
+func newTransferIdle(timeout time.Duration, stop func()) *transferIdle {
+	ret := &transferIdle{timeout: timeout}
+	ret.timer = time.AfterFunc(timeout, func() {
+		ret.expired.Store(true)
+		stop()
+	})
+	return ret
+}
+
+func (p *transferIdle) Write(data []byte) (int, error) {
+	if !p.expired.Load() {
+		p.timer.Reset(p.timeout)
+	}
+	return len(data), nil
+}
+
+// Stop stops watching the transfer
+func (p *transferIdle) Stop() {
+	p.timer.Stop()
+}
+
+// check returns a timeout error instead of err when the transfer was
+// stopped, the error of the stopped connection tells nothing
+func (p *transferIdle) check(name string, err error) error {
+	if err != nil && p.expired.Load() {
+		return Errorf("transfer of %s made no progress for %s: %w", name, p.timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,1246 @@
+package x
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP protocol version 3 packet types
+// https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+const (
+	sftpPacketInit     = 1
+	sftpPacketVersion  = 2
+	sftpPacketOpen     = 3
+	sftpPacketClose    = 4
+	sftpPacketRead     = 5
+	sftpPacketWrite    = 6
+	sftpPacketLstat    = 7
+	sftpPacketFstat    = 8
+	sftpPacketSetstat  = 9
+	sftpPacketFsetstat = 10
+	sftpPacketOpendir  = 11
+	sftpPacketReaddir  = 12
+	sftpPacketRemove   = 13
+	sftpPacketMkdir    = 14
+	sftpPacketRmdir    = 15
+	sftpPacketRealpath = 16
+	sftpPacketStat     = 17
+	sftpPacketRename   = 18
+	sftpPacketReadlink = 19
+	sftpPacketSymlink  = 20
+	sftpPacketStatus   = 101
+	sftpPacketHandle   = 102
+	sftpPacketData     = 103
+	sftpPacketName     = 104
+	sftpPacketAttrs    = 105
+	sftpPacketExtended = 200
+)
+
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpStatusOK               = 0
+	sftpStatusEOF              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusOpUnsupported    = 8
+)
+
+const (
+	// sftpChunkSize is the payload of a single READ or WRITE request
+	sftpChunkSize = 32 * 1024
+	// sftpMaxInflight is the number of READ or WRITE requests kept in flight
+	sftpMaxInflight = 64
+	// sftpMaxPacket is the largest packet we accept from the server
+	sftpMaxPacket = 256 * 1024
+)
+
+// ErrSFTPUnavailable is returned when the server does not provide the sftp subsystem
+var ErrSFTPUnavailable = errors.New("sftp subsystem is not available")
+
+// SFTPStatusError is returned when the server answers a request with a
+// failure status
+type SFTPStatusError struct {
+	Op      string
+	Path    string
+	Code    uint32
+	Message string
+}
+
+func (e *SFTPStatusError) Error() string {
+	return Sprintf("sftp %s %s: %s (code %d)", e.Op, e.Path, e.Message, e.Code)
+}
+
+func (e *SFTPStatusError) Is(target error) bool {
+	switch e.Code {
+	case sftpStatusNoSuchFile:
+		return target == os.ErrNotExist
+	case sftpStatusPermissionDenied:
+		return target == os.ErrPermission
+	case sftpStatusEOF:
+		return target == io.EOF
+	default:
+		return false
+	}
+}
+
+// sftpBuffer builds a request payload
+type sftpBuffer struct {
+	data []byte
+}
+
+func (b *sftpBuffer) byte(v byte) *sftpBuffer {
+	b.data = append(b.data, v)
+	return b
+}
+
+func (b *sftpBuffer) uint32(v uint32) *sftpBuffer {
+	b.data = binary.BigEndian.AppendUint32(b.data, v)
+	return b
+}
+
+func (b *sftpBuffer) uint64(v uint64) *sftpBuffer {
+	b.data = binary.BigEndian.AppendUint64(b.data, v)
+	return b
+}
+
+func (b *sftpBuffer) string(v string) *sftpBuffer {
+	b.uint32(uint32(len(v)))
+	b.data = append(b.data, v...)
+	return b
+}
+
+func (b *sftpBuffer) bytes(v []byte) *sftpBuffer {
+	b.uint32(uint32(len(v)))
+	b.data = append(b.data, v...)
+	return b
+}
+
+func (b *sftpBuffer) attrs(a *sftpAttrs) *sftpBuffer {
+	b.uint32(a.flags)
+	if a.flags&sftpAttrSize != 0 {
+		b.uint64(a.size)
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		b.uint32(a.uid).uint32(a.gid)
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		b.uint32(a.permissions)
+	}
+	if a.flags&sftpAttrACModTime != 0 {
+		b.uint32(a.atime).uint32(a.mtime)
+	}
+	return b
+}
+
+// sftpReader parses a response payload
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.data) < 8 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *sftpReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	} else if uint32(len(r.data)) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *sftpReader) attrs() *sftpAttrs {
+	a := &sftpAttrs{flags: r.uint32()}
+	if a.flags&sftpAttrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		a.uid = r.uint32()
+		a.gid = r.uint32()
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		a.permissions = r.uint32()
+	}
+	if a.flags&sftpAttrACModTime != 0 {
+		a.atime = r.uint32()
+		a.mtime = r.uint32()
+	}
+	if a.flags&sftpAttrExtended != 0 {
+		for range r.uint32() {
+			_ = r.string()
+			_ = r.string()
+		}
+	}
+	return a
+}
+
+type sftpAttrs struct {
+	flags       uint32
+	size        uint64
+	uid         uint32
+	gid         uint32
+	permissions uint32
+	atime       uint32
+	mtime       uint32
+}
+
+// SFTPFileStat is the raw attribute set returned by FileInfo.Sys()
+type SFTPFileStat struct {
+	UID   uint32
+	GID   uint32
+	Mode  uint32
+	Size  uint64
+	Atime uint32
+	Mtime uint32
+}
+
+type sftpFileInfo struct {
+	name  string
+	attrs *sftpAttrs
+}
+
+func (p *sftpFileInfo) Name() string {
+	return p.name
+}
+
+func (p *sftpFileInfo) Size() int64 {
+	return int64(p.attrs.size)
+}
+
+func (p *sftpFileInfo) Mode() os.FileMode {
+	return sftpToFileMode(p.attrs.permissions)
+}
+
+func (p *sftpFileInfo) ModTime() time.Time {
+	return time.Unix(int64(p.attrs.mtime), 0)
+}
+
+func (p *sftpFileInfo) IsDir() bool {
+	return p.Mode().IsDir()
+}
+
+func (p *sftpFileInfo) Sys() any {
+	return &SFTPFileStat{
+		UID:   p.attrs.uid,
+		GID:   p.attrs.gid,
+		Mode:  p.attrs.permissions,
+		Size:  p.attrs.size,
+		Atime: p.attrs.atime,
+		Mtime: p.attrs.mtime,
+	}
+}
+
+// sftpToFileMode converts posix st_mode bits into an os.FileMode
+func sftpToFileMode(mode uint32) os.FileMode {
+	ret := os.FileMode(mode & 0777)
+
+	switch mode & 0170000 {
+	case 0040000:
+		ret |= os.ModeDir
+	case 0120000:
+		ret |= os.ModeSymlink
+	case 0010000:
+		ret |= os.ModeNamedPipe
+	case 0140000:
+		ret |= os.ModeSocket
+	case 0020000:
+		ret |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		ret |= os.ModeDevice
+	}
+
+	if mode&04000 != 0 {
+		ret |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		ret |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		ret |= os.ModeSticky
+	}
+
+	return ret
+}
+
+// sftpFromFileMode converts permission bits of an os.FileMode into posix mode bits
+func sftpFromFileMode(mode os.FileMode) uint32 {
+	ret := uint32(mode.Perm())
+
+	if mode&os.ModeSetuid != 0 {
+		ret |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		ret |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		ret |= 01000
+	}
+
+	return ret
+}
+
+type sftpResponse struct {
+	typ  byte
+	data []byte
+	err  error
+}
+
+// SFTPClient is a client for the SFTP subsystem running on an SSH connection
+type SFTPClient struct {
+	session  io.Closer // the session the subsystem runs in
+	stdin    io.WriteCloser
+	stdout   io.Reader
+	writeMu  *sync.Mutex
+	mu       *sync.Mutex
+	nextID   uint32
+	pending  map[uint32]chan *sftpResponse
+	closeErr error
+	release  func() // frees the session slot of the SSHClient, may be nil
+}
+
+// SFTP opens a new SFTP session on the connection of the SSHClient, it
+// takes one of the sessions of SetMaxSessions until it is closed.
+// The caller is responsible for closing the returned client.
+func (p *SSHClient) SFTP() (*SFTPClient, error) {
+	release, err := p.acquireSession(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	client, err := p.openSFTP()
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	client.release = release
+	return client, nil
+}
+
+func (p *SSHClient) openSFTP() (*SFTPClient, error) {
+	if err := p.getLastError(); err != nil {
+		return nil, err
+	}
+
+	if p.runClient == nil {
+		return nil, Errorf("client is not open")
+	}
+
+	// like commands, a dead connection is redialed first
+	session, err := p.newSession()
+	if err != nil {
+		return nil, &SSHConnectionError{Host: p.config.Host, Err: Errorf("failed to create session: %w", err)}
+	}
+
+	return newSFTPClient(session)
+}
+
+// NewSFTPClient starts the sftp subsystem on the given SSH connection
+func NewSFTPClient(client *ssh.Client) (*SFTPClient, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, Errorf("failed to create session: %w", err)
+	}
+
+	return newSFTPClient(session)
+}
+
+// newSFTPClient starts the sftp subsystem on session, it is closed on errors
+func newSFTPClient(session *ssh.Session) (*SFTPClient, error) {
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, Errorf("failed to get stdin pipe: %w", err)
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, Errorf("failed to get stdout pipe: %w", err)
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		_ = session.Close()
+		return nil, Errorf("%w: %v", ErrSFTPUnavailable, err)
+	}
+
+	return startSFTPClient(session, stdin, stdout)
+}
+
+// startSFTPClient negotiates the protocol version with the subsystem that
+// reads stdin and writes stdout, session is closed on errors
+func startSFTPClient(session io.Closer, stdin io.WriteCloser, stdout io.Reader) (*SFTPClient, error) {
+	ret := &SFTPClient{
+		session: session,
+		stdin:   stdin,
+		stdout:  stdout,
+		writeMu: &sync.Mutex{},
+		mu:      &sync.Mutex{},
+		nextID:  0,
+		pending: map[uint32]chan *sftpResponse{},
+	}
+
+	// INIT and VERSION do not carry a request id
+	init := (&sftpBuffer{}).byte(sftpPacketInit).uint32(3)
+	if err := ret.writePacket(init.data); err != nil {
+		_ = ret.Close()
+		return nil, Errorf("%w: failed to send init: %v", ErrSFTPUnavailable, err)
+	}
+
+	if typ, data, err := ret.readPacket(); err != nil {
+		_ = ret.Close()
+		return nil, Errorf("%w: failed to read version: %v", ErrSFTPUnavailable, err)
+	} else if typ != sftpPacketVersion {
+		_ = ret.Close()
+		return nil, Errorf("%w: unexpected packet %d, expected version", ErrSFTPUnavailable, typ)
+	} else if len(data) < 4 || binary.BigEndian.Uint32(data) != 3 {
+		_ = ret.Close()
+		return nil, Errorf("%w: unsupported version", ErrSFTPUnavailable)
+	}
+
+	go ret.readLoop()
+
+	return ret, nil
+}
+
+// Close ends the SFTP session
+func (p *SFTPClient) Close() error {
+	p.fail(Errorf("sftp client is closed"))
+	_ = p.stdin.Close()
+	ret := p.session.Close()
+
+	p.mu.Lock()
+	release := p.release
+	p.release = nil
+	p.mu.Unlock()
+
+	if release != nil {
+		release()
+	}
+	return ret
+}
+
+func (p *SFTPClient) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closeErr != nil {
+		return
+	}
+
+	p.closeErr = err
+	for id, ch := range p.pending {
+		ch <- &sftpResponse{err: err}
+		delete(p.pending, id)
+	}
+}
+
+func (p *SFTPClient) writePacket(payload []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	if _, err := p.stdin.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *SFTPClient) readPacket() (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(p.stdout, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > sftpMaxPacket {
+		return 0, nil, Errorf("invalid sftp packet length %d", length)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(p.stdout, packet); err != nil {
+		return 0, nil, err
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+func (p *SFTPClient) readLoop() {
+	for {
+		typ, data, err := p.readPacket()
+		if err != nil {
+			p.fail(Errorf("sftp connection lost: %w", err))
+			return
+		} else if len(data) < 4 {
+			p.fail(Errorf("sftp packet %d is too short", typ))
+			return
+		}
+
+		id := binary.BigEndian.Uint32(data)
+
+		p.mu.Lock()
+		ch, ok := p.pending[id]
+		delete(p.pending, id)
+		p.mu.Unlock()
+
+		if ok {
+			ch <- &sftpResponse{typ: typ, data: data[4:]}
+		}
+	}
+}
+
+// send writes a request and returns the channel its response arrives on
+func (p *SFTPClient) send(typ byte, build func(b *sftpBuffer)) (<-chan *sftpResponse, error) {
+	ch := make(chan *sftpResponse, 1)
+
+	p.mu.Lock()
+	if p.closeErr != nil {
+		p.mu.Unlock()
+		return nil, p.closeErr
+	}
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = ch
+	p.mu.Unlock()
+
+	b := (&sftpBuffer{}).byte(typ).uint32(id)
+	build(b)
+
+	if err := p.writePacket(b.data); err != nil {
+		p.fail(Errorf("sftp connection lost: %w", err))
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+func (p *SFTPClient) request(typ byte, build func(b *sftpBuffer)) (*sftpResponse, error) {
+	if ch, err := p.send(typ, build); err != nil {
+		return nil, err
+	} else if resp := <-ch; resp.err != nil {
+		return nil, resp.err
+	} else {
+		return resp, nil
+	}
+}
+
+// statusError converts a STATUS response into an error, nil means OK
+func statusError(resp *sftpResponse, op string, filePath string) error {
+	if resp.typ != sftpPacketStatus {
+		return Errorf("sftp %s %s: unexpected packet %d", op, filePath, resp.typ)
+	}
+
+	r := &sftpReader{data: resp.data}
+	code := r.uint32()
+	message := r.string()
+
+	if r.err != nil {
+		return Errorf("sftp %s %s: malformed status: %w", op, filePath, r.err)
+	} else if code == sftpStatusOK {
+		return nil
+	} else {
+		return &SFTPStatusError{Op: op, Path: filePath, Code: code, Message: message}
+	}
+}
+
+func (p *SFTPClient) simple(op string, typ byte, filePath string, build func(b *sftpBuffer)) error {
+	if resp, err := p.request(typ, build); err != nil {
+		return err
+	} else {
+		return statusError(resp, op, filePath)
+	}
+}
+
+func (p *SFTPClient) attrsRequest(op string, typ byte, filePath string, build func(b *sftpBuffer)) (*sftpAttrs, error) {
+	resp, err := p.request(typ, build)
+	if err != nil {
+		return nil, err
+	} else if resp.typ != sftpPacketAttrs {
+		return nil, statusError(resp, op, filePath)
+	}
+
+	r := &sftpReader{data: resp.data}
+	if attrs := r.attrs(); r.err != nil {
+		return nil, Errorf("sftp %s %s: malformed attrs: %w", op, filePath, r.err)
+	} else {
+		return attrs, nil
+	}
+}
+
+func (p *SFTPClient) handleRequest(op string, typ byte, filePath string, build func(b *sftpBuffer)) (string, error) {
+	resp, err := p.request(typ, build)
+	if err != nil {
+		return "", err
+	} else if resp.typ != sftpPacketHandle {
+		return "", statusError(resp, op, filePath)
+	}
+
+	r := &sftpReader{data: resp.data}
+	if handle := r.string(); r.err != nil {
+		return "", Errorf("sftp %s %s: malformed handle: %w", op, filePath, r.err)
+	} else {
+		return handle, nil
+	}
+}
+
+// Stat returns the file info of path, following symlinks
+func (p *SFTPClient) Stat(filePath string) (os.FileInfo, error) {
+	if attrs, err := p.attrsRequest("stat", sftpPacketStat, filePath, func(b *sftpBuffer) {
+		b.string(filePath)
+	}); err != nil {
+		return nil, err
+	} else {
+		return &sftpFileInfo{name: path.Base(filePath), attrs: attrs}, nil
+	}
+}
+
+// Lstat returns the file info of path without following symlinks
+func (p *SFTPClient) Lstat(filePath string) (os.FileInfo, error) {
+	if attrs, err := p.attrsRequest("lstat", sftpPacketLstat, filePath, func(b *sftpBuffer) {
+		b.string(filePath)
+	}); err != nil {
+		return nil, err
+	} else {
+		return &sftpFileInfo{name: path.Base(filePath), attrs: attrs}, nil
+	}
+}
+
+// ReadDir lists the entries of a remote directory, without "." and ".."
+func (p *SFTPClient) ReadDir(dirPath string) ([]os.FileInfo, error) {
+	handle, err := p.handleRequest("opendir", sftpPacketOpendir, dirPath, func(b *sftpBuffer) {
+		b.string(dirPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer p.closeHandle(handle, dirPath)
+
+	ret := []os.FileInfo{}
+	for {
+		resp, err := p.request(sftpPacketReaddir, func(b *sftpBuffer) {
+			b.string(handle)
+		})
+		if err != nil {
+			return nil, err
+		} else if resp.typ != sftpPacketName {
+			if err := statusError(resp, "readdir", dirPath); errors.Is(err, io.EOF) {
+				return ret, nil
+			} else if err != nil {
+				return nil, err
+			} else {
+				return nil, Errorf("sftp readdir %s: unexpected ok status", dirPath)
+			}
+		}
+
+		r := &sftpReader{data: resp.data}
+		for range r.uint32() {
+			name := r.string()
+			_ = r.string() // long name
+			attrs := r.attrs()
+			if r.err != nil {
+				return nil, Errorf("sftp readdir %s: malformed name: %w", dirPath, r.err)
+			} else if name != "." && name != ".." {
+				ret = append(ret, &sftpFileInfo{name: name, attrs: attrs})
+			} else {
+				Ignore()
+			}
+		}
+	}
+}
+
+// Mkdir creates a remote directory
+func (p *SFTPClient) Mkdir(dirPath string, mode os.FileMode) error {
+	return p.simple("mkdir", sftpPacketMkdir, dirPath, func(b *sftpBuffer) {
+		b.string(dirPath).attrs(&sftpAttrs{
+			flags:       sftpAttrPermissions,
+			permissions: sftpFromFileMode(mode),
+		})
+	})
+}
+
+// MkdirAll creates a remote directory with all missing parents
+func (p *SFTPClient) MkdirAll(dirPath string, mode os.FileMode) error {
+	if info, err := p.Stat(dirPath); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return Errorf("sftp mkdir %s: not a directory", dirPath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if parent := path.Dir(dirPath); parent != dirPath {
+		if err := p.MkdirAll(parent, mode); err != nil {
+			return err
+		}
+	}
+
+	if err := p.Mkdir(dirPath, mode); err != nil {
+		// the directory may have been created concurrently
+		if info, statErr := p.Stat(dirPath); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Remove removes a remote file
+func (p *SFTPClient) Remove(filePath string) error {
+	return p.simple("remove", sftpPacketRemove, filePath, func(b *sftpBuffer) {
+		b.string(filePath)
+	})
+}
+
+// RemoveDirectory removes an empty remote directory
+func (p *SFTPClient) RemoveDirectory(dirPath string) error {
+	return p.simple("rmdir", sftpPacketRmdir, dirPath, func(b *sftpBuffer) {
+		b.string(dirPath)
+	})
+}
+
+// Rename renames a remote file. Existing targets are replaced when the
+// server supports the posix-rename@openssh.com extension.
+func (p *SFTPClient) Rename(oldPath string, newPath string) error {
+	err := p.simple("rename", sftpPacketExtended, oldPath, func(b *sftpBuffer) {
+		b.string("posix-rename@openssh.com").string(oldPath).string(newPath)
+	})
+
+	statusErr := (*SFTPStatusError)(nil)
+	if errors.As(err, &statusErr) && statusErr.Code == sftpStatusOpUnsupported {
+		return p.simple("rename", sftpPacketRename, oldPath, func(b *sftpBuffer) {
+			b.string(oldPath).string(newPath)
+		})
+	}
+
+	return err
+}
+
+// Chmod changes the permission bits of a remote file
+func (p *SFTPClient) Chmod(filePath string, mode os.FileMode) error {
+	return p.simple("chmod", sftpPacketSetstat, filePath, func(b *sftpBuffer) {
+		b.string(filePath).attrs(&sftpAttrs{
+			flags:       sftpAttrPermissions,
+			permissions: sftpFromFileMode(mode),
+		})
+	})
+}
+
+// Chown changes the numeric owner and group of a remote file
+func (p *SFTPClient) Chown(filePath string, uid int, gid int) error {
+	return p.simple("chown", sftpPacketSetstat, filePath, func(b *sftpBuffer) {
+		b.string(filePath).attrs(&sftpAttrs{
+			flags: sftpAttrUIDGID,
+			uid:   uint32(uid),
+			gid:   uint32(gid),
+		})
+	})
+}
+
+// RealPath canonicalizes a remote path, "." resolves to the home directory
+func (p *SFTPClient) RealPath(filePath string) (string, error) {
+	resp, err := p.request(sftpPacketRealpath, func(b *sftpBuffer) {
+		b.string(filePath)
+	})
+	if err != nil {
+		return "", err
+	} else if resp.typ != sftpPacketName {
+		return "", statusError(resp, "realpath", filePath)
+	}
+
+	r := &sftpReader{data: resp.data}
+	if count := r.uint32(); count != 1 {
+		return "", Errorf("sftp realpath %s: unexpected %d names", filePath, count)
+	} else if name := r.string(); r.err != nil {
+		return "", Errorf("sftp realpath %s: malformed name: %w", filePath, r.err)
+	} else {
+		return name, nil
+	}
+}
+
+// ReadLink returns the target of a remote symlink
+func (p *SFTPClient) ReadLink(linkPath string) (string, error) {
+	resp, err := p.request(sftpPacketReadlink, func(b *sftpBuffer) {
+		b.string(linkPath)
+	})
+	if err != nil {
+		return "", err
+	} else if resp.typ != sftpPacketName {
+		return "", statusError(resp, "readlink", linkPath)
+	}
+
+	r := &sftpReader{data: resp.data}
+	if count := r.uint32(); count != 1 {
+		return "", Errorf("sftp readlink %s: unexpected %d names", linkPath, count)
+	} else if target := r.string(); r.err != nil {
+		return "", Errorf("sftp readlink %s: malformed name: %w", linkPath, r.err)
+	} else {
+		return target, nil
+	}
+}
+
+// Symlink creates linkPath pointing at target
+func (p *SFTPClient) Symlink(target string, linkPath string) error {
+	// OpenSSH swapped the arguments of SSH_FXP_SYMLINK, every server in
+	// practice expects the target first
+	return p.simple("symlink", sftpPacketSymlink, linkPath, func(b *sftpBuffer) {
+		b.string(target).string(linkPath)
+	})
+}
+
+func (p *SFTPClient) closeHandle(handle string, filePath string) error {
+	return p.simple("close", sftpPacketClose, filePath, func(b *sftpBuffer) {
+		b.string(handle)
+	})
+}
+
+// Open opens a remote file for reading
+func (p *SFTPClient) Open(filePath string) (*SFTPFile, error) {
+	return p.OpenFile(filePath, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates a remote file for writing
+func (p *SFTPClient) Create(filePath string, mode os.FileMode) (*SFTPFile, error) {
+	return p.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+}
+
+// OpenFile opens a remote file with os.O_* flags
+func (p *SFTPClient) OpenFile(filePath string, flag int, mode os.FileMode) (*SFTPFile, error) {
+	pflags := uint32(0)
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		pflags |= sftpFlagRead
+	case os.O_WRONLY:
+		pflags |= sftpFlagWrite
+	case os.O_RDWR:
+		pflags |= sftpFlagRead | sftpFlagWrite
+	}
+	if flag&os.O_APPEND != 0 {
+		pflags |= sftpFlagAppend
+	}
+	if flag&os.O_CREATE != 0 {
+		pflags |= sftpFlagCreate
+	}
+	if flag&os.O_TRUNC != 0 {
+		pflags |= sftpFlagTrunc
+	}
+	if flag&os.O_EXCL != 0 {
+		pflags |= sftpFlagExcl
+	}
+
+	handle, err := p.handleRequest("open", sftpPacketOpen, filePath, func(b *sftpBuffer) {
+		b.string(filePath).uint32(pflags).attrs(&sftpAttrs{
+			flags:       sftpAttrPermissions,
+			permissions: sftpFromFileMode(mode),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &SFTPFile{
+		client: p,
+		path:   filePath,
+		handle: handle,
+		offset: 0,
+	}
+
+	// writes to an O_APPEND file start at its current end
+	if flag&os.O_APPEND != 0 {
+		if info, err := ret.Stat(); err != nil {
+			_ = ret.Close()
+			return nil, err
+		} else {
+			ret.offset = info.Size()
+		}
+	}
+
+	return ret, nil
+}
+
+// Upload copies a local file to a remote path, creating or truncating it
+func (p *SFTPClient) Upload(localPath string, remotePath string, mode os.FileMode) error {
+	file, err := os.Open(expandHomePath(localPath))
+	if err != nil {
+		return Errorf("failed to open local file %s: %w", localPath, err)
+	}
+	defer file.Close()
+
+	remote, err := p.Create(remotePath, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := remote.ReadFrom(file); err != nil {
+		_ = remote.Close()
+		return err
+	}
+
+	return remote.Close()
+}
+
+// Download copies a remote file to a local path, creating or truncating it
+func (p *SFTPClient) Download(remotePath string, localPath string, mode os.FileMode) error {
+	remote, err := p.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	file, err := os.OpenFile(expandHomePath(localPath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return Errorf("failed to create local file %s: %w", localPath, err)
+	}
+
+	if _, err := remote.WriteTo(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// SFTPFile is an open remote file
+type SFTPFile struct {
+	client *SFTPClient
+	path   string
+	handle string
+	offset int64
+}
+
+// Name returns the remote path of the file
+func (p *SFTPFile) Name() string {
+	return p.path
+}
+
+// Close closes the remote handle
+func (p *SFTPFile) Close() error {
+	return p.client.closeHandle(p.handle, p.path)
+}
+
+// Stat returns the file info of the open file
+func (p *SFTPFile) Stat() (os.FileInfo, error) {
+	if attrs, err := p.client.attrsRequest("fstat", sftpPacketFstat, p.path, func(b *sftpBuffer) {
+		b.string(p.handle)
+	}); err != nil {
+		return nil, err
+	} else {
+		return &sftpFileInfo{name: path.Base(p.path), attrs: attrs}, nil
+	}
+}
+
+// Chmod changes the permission bits of the open file
+func (p *SFTPFile) Chmod(mode os.FileMode) error {
+	return p.client.simple("chmod", sftpPacketFsetstat, p.path, func(b *sftpBuffer) {
+		b.string(p.handle).attrs(&sftpAttrs{
+			flags:       sftpAttrPermissions,
+			permissions: sftpFromFileMode(mode),
+		})
+	})
+}
+
+// Seek sets the offset for the next Read or Write
+func (p *SFTPFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		Ignore()
+	case io.SeekCurrent:
+		offset += p.offset
+	case io.SeekEnd:
+		if info, err := p.Stat(); err != nil {
+			return 0, err
+		} else {
+			offset += info.Size()
+		}
+	default:
+		return 0, Errorf("sftp seek %s: invalid whence %d", p.path, whence)
+	}
+
+	if offset < 0 {
+		return 0, Errorf("sftp seek %s: negative offset", p.path)
+	}
+
+	p.offset = offset
+	return offset, nil
+}
+
+func (p *SFTPFile) sendRead(offset int64, length int) (<-chan *sftpResponse, error) {
+	return p.client.send(sftpPacketRead, func(b *sftpBuffer) {
+		b.string(p.handle).uint64(uint64(offset)).uint32(uint32(length))
+	})
+}
+
+// readResponse copies a READ response into buf, io.EOF marks the end of file
+func (p *SFTPFile) readResponse(resp *sftpResponse, buf []byte) (int, error) {
+	if resp.err != nil {
+		return 0, resp.err
+	} else if resp.typ != sftpPacketData {
+		if err := statusError(resp, "read", p.path); err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		return 0, Errorf("sftp read %s: unexpected ok status", p.path)
+	}
+
+	r := &sftpReader{data: resp.data}
+	data := r.bytes()
+	if r.err != nil {
+		return 0, Errorf("sftp read %s: malformed data: %w", p.path, r.err)
+	} else if len(data) > len(buf) {
+		return 0, Errorf("sftp read %s: server sent too much data", p.path)
+	}
+
+	return copy(buf, data), nil
+}
+
+// ReadAt reads len(buf) bytes from the remote file at offset
+func (p *SFTPFile) ReadAt(buf []byte, offset int64) (int, error) {
+	read := 0
+	for read < len(buf) {
+		length := Min(len(buf)-read, sftpChunkSize)
+		ch, err := p.sendRead(offset+int64(read), length)
+		if err != nil {
+			return read, err
+		}
+
+		n, err := p.readResponse(<-ch, buf[read:read+length])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+// Read reads from the current offset of the remote file
+func (p *SFTPFile) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	ch, err := p.sendRead(p.offset, Min(len(buf), sftpChunkSize))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := p.readResponse(<-ch, buf)
+	p.offset += int64(n)
+	return n, err
+}
+
+// WriteTo streams the remote file from the current offset into w, keeping
+// several READ requests in flight
+func (p *SFTPFile) WriteTo(w io.Writer) (int64, error) {
+	type inflight struct {
+		offset int64
+		ch     <-chan *sftpResponse
+	}
+
+	queue := []inflight{}
+	next := p.offset
+	written := int64(0)
+	buf := make([]byte, sftpChunkSize)
+	eof := false
+
+	for {
+		for !eof && len(queue) < sftpMaxInflight {
+			if ch, err := p.sendRead(next, sftpChunkSize); err != nil {
+				return written, err
+			} else {
+				queue = append(queue, inflight{offset: next, ch: ch})
+				next += sftpChunkSize
+			}
+		}
+
+		if len(queue) == 0 {
+			return written, nil
+		}
+
+		head := queue[0]
+		queue = queue[1:]
+
+		n, err := p.readResponse(<-head.ch, buf)
+		if err == io.EOF {
+			// later requests are past the end as well
+			eof = true
+			queue = nil
+			continue
+		} else if err != nil {
+			return written, err
+		}
+
+		if _, err := w.Write(buf[:n]); err != nil {
+			return written, err
+		}
+		written += int64(n)
+		p.offset = head.offset + int64(n)
+
+		// a short read leaves a hole before the next request, fetch it
+		// synchronously and restart the pipeline afterwards
+		if n < sftpChunkSize {
+			rest := make([]byte, sftpChunkSize-n)
+			m, err := p.ReadAt(rest, p.offset)
+			if m > 0 {
+				if _, err := w.Write(rest[:m]); err != nil {
+					return written, err
+				}
+				written += int64(m)
+				p.offset += int64(m)
+			}
+
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return written, err
+			}
+
+			for _, item := range queue {
+				<-item.ch
+			}
+			queue = nil
+			next = p.offset
+		}
+	}
+}
+
+func (p *SFTPFile) sendWrite(offset int64, data []byte) (<-chan *sftpResponse, error) {
+	return p.client.send(sftpPacketWrite, func(b *sftpBuffer) {
+		b.string(p.handle).uint64(uint64(offset)).bytes(data)
+	})
+}
+
+func (p *SFTPFile) writeResponse(resp *sftpResponse) error {
+	if resp.err != nil {
+		return resp.err
+	}
+	return statusError(resp, "write", p.path)
+}
+
+// WriteAt writes buf into the remote file at offset
+func (p *SFTPFile) WriteAt(buf []byte, offset int64) (int, error) {
+	written := 0
+	for written < len(buf) {
+		length := Min(len(buf)-written, sftpChunkSize)
+		if ch, err := p.sendWrite(offset+int64(written), buf[written:written+length]); err != nil {
+			return written, err
+		} else if err := p.writeResponse(<-ch); err != nil {
+			return written, err
+		} else {
+			written += length
+		}
+	}
+
+	return written, nil
+}
+
+// Write writes at the current offset of the remote file
+func (p *SFTPFile) Write(buf []byte) (int, error) {
+	n, err := p.WriteAt(buf, p.offset)
+	p.offset += int64(n)
+	return n, err
+}
+
+// ReadFrom streams r into the remote file from the current offset, keeping
+// several WRITE requests in flight
+func (p *SFTPFile) ReadFrom(r io.Reader) (int64, error) {
+	queue := []<-chan *sftpResponse{}
+	written := int64(0)
+
+	wait := func() error {
+		head := queue[0]
+		queue = queue[1:]
+		return p.writeResponse(<-head)
+	}
+
+	for {
+		buf := make([]byte, sftpChunkSize)
+		n, readErr := io.ReadFull(r, buf)
+
+		if n > 0 {
+			ch, err := p.sendWrite(p.offset, buf[:n])
+			if err != nil {
+				return written, err
+			}
+			queue = append(queue, ch)
+			p.offset += int64(n)
+			written += int64(n)
+		}
+
+		if len(queue) >= sftpMaxInflight {
+			if err := wait(); err != nil {
+				return written, err
+			}
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return written, readErr
+		}
+	}
+
+	for len(queue) > 0 {
+		if err := wait(); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
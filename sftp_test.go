@@ -0,0 +1,391 @@
+package x
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// sftpPacket encodes a packet field by field as the draft defines it,
+// independent of sftpBuffer. Ints are uint32 and strings are length
+// prefixed.
+func sftpPacket(fields ...any) []byte {
+	payload := []byte{}
+	for _, field := range fields {
+		switch v := field.(type) {
+		case byte:
+			payload = append(payload, v)
+		case int:
+			payload = binary.BigEndian.AppendUint32(payload, uint32(v))
+		case uint64:
+			payload = binary.BigEndian.AppendUint64(payload, v)
+		case string:
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(v)))
+			payload = append(payload, v...)
+		default:
+			Panicf("sftpPacket: unsupported field %T", field)
+		}
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+}
+
+// sftpStep is a request the client must send and the packet answering it
+type sftpStep struct {
+	request  []byte
+	response []byte
+}
+
+// sftpPipes closes both ends of the pipes between client and peer
+type sftpPipes []interface{ CloseWithError(error) error }
+
+func (p sftpPipes) Close() error {
+	for _, pipe := range p {
+		_ = pipe.CloseWithError(io.ErrClosedPipe)
+	}
+	return nil
+}
+
+// startScriptedSFTP starts a client on a peer that expects the requests of
+// steps byte by byte, after the version negotiation
+func startScriptedSFTP(t *testing.T, steps []sftpStep) *SFTPClient {
+	t.Helper()
+
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	pipes := sftpPipes{requestReader, requestWriter, responseReader, responseWriter}
+
+	// OpenSSH announces its extensions after the version
+	steps = append([]sftpStep{{
+		request:  sftpPacket(byte(sftpPacketInit), 3),
+		response: sftpPacket(byte(sftpPacketVersion), 3, "posix-rename@openssh.com", "1"),
+	}}, steps...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i, step := range steps {
+			request := make([]byte, len(step.request))
+			if _, err := io.ReadFull(requestReader, request); err != nil {
+				t.Errorf("step %d: failed to read the request: %v", i, err)
+				_ = pipes.Close()
+				return
+			} else if !slices.Equal(request, step.request) {
+				t.Errorf("step %d: got request\n%x\nwant\n%x", i, request, step.request)
+				_ = pipes.Close()
+				return
+			} else if _, err := responseWriter.Write(step.response); err != nil {
+				t.Errorf("step %d: failed to write the response: %v", i, err)
+				return
+			}
+		}
+	}()
+
+	client, err := startSFTPClient(pipes, requestWriter, responseReader)
+	if err != nil {
+		t.Fatalf("startSFTPClient: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		<-done
+	})
+	return client
+}
+
+func TestSFTPClientPackets(t *testing.T) {
+	ok := func(id int) []byte {
+		return sftpPacket(byte(sftpPacketStatus), id, sftpStatusOK, "Success", "")
+	}
+
+	tests := []struct {
+		name  string
+		steps []sftpStep
+		run   func(client *SFTPClient) error
+	}{
+		{
+			name: "stat",
+			steps: []sftpStep{{
+				request:  sftpPacket(byte(sftpPacketStat), 1, "/etc"),
+				response: sftpPacket(byte(sftpPacketAttrs), 1, sftpAttrSize|sftpAttrPermissions, uint64(4096), 040755),
+			}},
+			run: func(client *SFTPClient) error {
+				if info, err := client.Stat("/etc"); err != nil {
+					return err
+				} else if !info.IsDir() || info.Size() != 4096 || info.Mode().Perm() != 0755 {
+					return Errorf("unexpected info %v %d", info.Mode(), info.Size())
+				}
+				return nil
+			},
+		},
+		{
+			name: "stat missing",
+			steps: []sftpStep{{
+				request:  sftpPacket(byte(sftpPacketStat), 1, "/missing"),
+				response: sftpPacket(byte(sftpPacketStatus), 1, sftpStatusNoSuchFile, "No such file", "en"),
+			}},
+			run: func(client *SFTPClient) error {
+				if _, err := client.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+					return Errorf("expected os.ErrNotExist, got %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "mkdir",
+			steps: []sftpStep{{
+				request:  sftpPacket(byte(sftpPacketMkdir), 1, "/opt/app", sftpAttrPermissions, 0755),
+				response: ok(1),
+			}},
+			run: func(client *SFTPClient) error {
+				return client.Mkdir("/opt/app", 0755)
+			},
+		},
+		{
+			name: "create",
+			steps: []sftpStep{{
+				request: sftpPacket(
+					byte(sftpPacketOpen), 1, "/opt/app/app.conf",
+					sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc, sftpAttrPermissions, 0640,
+				),
+				response: sftpPacket(byte(sftpPacketHandle), 1, "h1"),
+			}, {
+				request:  sftpPacket(byte(sftpPacketWrite), 2, "h1", uint64(0), "port = 80\n"),
+				response: ok(2),
+			}, {
+				request:  sftpPacket(byte(sftpPacketClose), 3, "h1"),
+				response: ok(3),
+			}},
+			run: func(client *SFTPClient) error {
+				file, err := client.Create("/opt/app/app.conf", 0640)
+				if err != nil {
+					return err
+				} else if _, err := file.Write([]byte("port = 80\n")); err != nil {
+					return err
+				}
+				return file.Close()
+			},
+		},
+		{
+			name: "read",
+			steps: []sftpStep{{
+				request:  sftpPacket(byte(sftpPacketOpen), 1, "/etc/hostname", sftpFlagRead, sftpAttrPermissions, 0),
+				response: sftpPacket(byte(sftpPacketHandle), 1, "h1"),
+			}, {
+				request:  sftpPacket(byte(sftpPacketRead), 2, "h1", uint64(0), 5),
+				response: sftpPacket(byte(sftpPacketData), 2, "web-1"),
+			}, {
+				request:  sftpPacket(byte(sftpPacketClose), 3, "h1"),
+				response: ok(3),
+			}},
+			run: func(client *SFTPClient) error {
+				file, err := client.Open("/etc/hostname")
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+
+				buf := make([]byte, 5)
+				if _, err := file.ReadAt(buf, 0); err != nil {
+					return err
+				} else if string(buf) != "web-1" {
+					return Errorf("read %q", buf)
+				}
+				return nil
+			},
+		},
+		{
+			name: "readdir",
+			steps: []sftpStep{{
+				request:  sftpPacket(byte(sftpPacketOpendir), 1, "/opt"),
+				response: sftpPacket(byte(sftpPacketHandle), 1, "d1"),
+			}, {
+				request: sftpPacket(byte(sftpPacketReaddir), 2, "d1"),
+				response: sftpPacket(
+					byte(sftpPacketName), 2, 3,
+					".", "drwxr-xr-x    2 root     root         4096 Jan  1 00:00 .", 0,
+					"..", "drwxr-xr-x    2 root     root         4096 Jan  1 00:00 ..", 0,
+					"app", "-rw-r--r--    1 root     root            5 Jan  1 00:00 app", sftpAttrSize, uint64(5),
+				),
+			}, {
+				request:  sftpPacket(byte(sftpPacketReaddir), 3, "d1"),
+				response: sftpPacket(byte(sftpPacketStatus), 3, sftpStatusEOF, "End of file", ""),
+			}, {
+				request:  sftpPacket(byte(sftpPacketClose), 4, "d1"),
+				response: ok(4),
+			}},
+			run: func(client *SFTPClient) error {
+				if infos, err := client.ReadDir("/opt"); err != nil {
+					return err
+				} else if len(infos) != 1 || infos[0].Name() != "app" || infos[0].Size() != 5 {
+					return Errorf("unexpected entries %v", infos)
+				}
+				return nil
+			},
+		},
+		{
+			name: "rename without posix-rename",
+			steps: []sftpStep{{
+				request:  sftpPacket(byte(sftpPacketExtended), 1, "posix-rename@openssh.com", "/tmp/a", "/opt/a"),
+				response: sftpPacket(byte(sftpPacketStatus), 1, sftpStatusOpUnsupported, "Operation unsupported", ""),
+			}, {
+				request:  sftpPacket(byte(sftpPacketRename), 2, "/tmp/a", "/opt/a"),
+				response: ok(2),
+			}},
+			run: func(client *SFTPClient) error {
+				return client.Rename("/tmp/a", "/opt/a")
+			},
+		},
+		{
+			name: "symlink",
+			steps: []sftpStep{{
+				// the target goes first like OpenSSH expects
+				request:  sftpPacket(byte(sftpPacketSymlink), 1, "app.conf", "/opt/app/current.conf"),
+				response: ok(1),
+			}},
+			run: func(client *SFTPClient) error {
+				return client.Symlink("app.conf", "/opt/app/current.conf")
+			},
+		},
+		{
+			name: "chown",
+			steps: []sftpStep{{
+				request:  sftpPacket(byte(sftpPacketSetstat), 1, "/opt/app", sftpAttrUIDGID, 1000, 1001),
+				response: ok(1),
+			}},
+			run: func(client *SFTPClient) error {
+				return client.Chown("/opt/app", 1000, 1001)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.run(startScriptedSFTP(t, test.steps)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// sftpProcess stops an sftp-server started by a test
+type sftpProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *sftpProcess) Close() error {
+	_ = p.cmd.Process.Kill()
+	return p.cmd.Wait()
+}
+
+func TestSFTPServerBinary(t *testing.T) {
+	// the sftp-server of OpenSSH, a reference the fake server of sshtest
+	// can not be
+	server := ""
+	for _, candidate := range []string{
+		"/usr/lib/openssh/sftp-server", "/usr/libexec/openssh/sftp-server",
+		"/usr/libexec/sftp-server", "/usr/lib/ssh/sftp-server",
+	} {
+		if fileExists(candidate) {
+			server = candidate
+			break
+		}
+	}
+	if server == "" {
+		t.Skip("sftp-server is not installed")
+	}
+
+	cmd := exec.Command(server)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := startSFTPClient(&sftpProcess{cmd: cmd}, stdin, stdout)
+	if err != nil {
+		t.Fatalf("startSFTPClient: %v", err)
+	}
+	defer client.Close()
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "opt", "app")
+	if err := client.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	// larger than one chunk, so several requests are in flight
+	data := make([]byte, 3*sftpChunkSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, name := range []string{"data.tmp", "data"} {
+		file, err := client.Create(filepath.Join(dir, name), 0640)
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		} else if _, err := file.Write(data); err != nil {
+			t.Fatalf("Write: %v", err)
+		} else if err := file.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	// posix-rename replaces the existing file
+	if err := client.Rename(filepath.Join(dir, "data.tmp"), filepath.Join(dir, "data")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	} else if err := client.Chmod(filepath.Join(dir, "data"), 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "data")); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != int64(len(data)) || info.Mode().Perm() != 0600 {
+		t.Fatalf("uploaded %d bytes with mode %v", info.Size(), info.Mode())
+	}
+
+	file, err := client.Open(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	content, err := io.ReadAll(file)
+	_ = file.Close()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	} else if !slices.Equal(content, data) {
+		t.Fatalf("read %d bytes, want %d", len(content), len(data))
+	}
+
+	link := filepath.Join(dir, "current")
+	if err := client.Symlink("data", link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	} else if target, err := client.ReadLink(link); err != nil || target != "data" {
+		t.Fatalf("ReadLink: %q, %v", target, err)
+	} else if info, err := client.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("Lstat: %v", err)
+	}
+
+	if infos, err := client.ReadDir(dir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	} else if len(infos) != 2 {
+		t.Fatalf("ReadDir returned %d entries", len(infos))
+	}
+
+	if err := client.Remove(link); err != nil {
+		t.Fatalf("Remove: %v", err)
+	} else if err := client.Remove(filepath.Join(dir, "data")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	} else if err := client.RemoveDirectory(dir); err != nil {
+		t.Fatalf("RemoveDirectory: %v", err)
+	} else if _, err := client.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package x
+
+import (
+	"strings"
+)
+
+// shellSafeChars never need quoting in a POSIX shell word
+const shellSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./:@%+=,"
+
+// ShellQuote quotes s as a single POSIX shell word, it is returned as is
+// when it has no special characters
+func ShellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+
+	if strings.Trim(s, shellSafeChars) == "" {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ShellArgs quotes every argument with ShellQuote and joins them with spaces,
+// use it for the arguments of SSH and Command format strings:
+//
+//	client.SSH("rm -f %s", x.ShellArgs(path))
+func ShellArgs(args ...any) string {
+	words := make([]string, 0, len(args))
+	for _, arg := range args {
+		words = append(words, ShellQuote(Sprint(arg)))
+	}
+	return strings.Join(words, " ")
+}
+
+// ShellSplit splits a command line into words like a POSIX shell does,
+// without expanding variables. It understands single quotes, double
+// quotes and backslash escapes.
+func ShellSplit(s string) ([]string, error) {
+	ret := []string{}
+	word := strings.Builder{}
+	inWord := false
+	inSingleQuote := false
+	inDoubleQuote := false
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+
+		if inSingleQuote {
+			if ch == '\'' {
+				inSingleQuote = false
+			} else {
+				word.WriteByte(ch)
+			}
+		} else if inDoubleQuote {
+			if ch == '"' {
+				inDoubleQuote = false
+			} else if ch == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+				i++
+				word.WriteByte(s[i])
+			} else {
+				word.WriteByte(ch)
+			}
+		} else if ch == '\'' {
+			inSingleQuote, inWord = true, true
+		} else if ch == '"' {
+			inDoubleQuote, inWord = true, true
+		} else if ch == '\\' {
+			if i+1 >= len(s) {
+				return nil, Errorf("unterminated escape in %q", s)
+			}
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		} else if ch == ' ' || ch == '\t' || ch == '\n' {
+			if inWord {
+				ret = append(ret, word.String())
+				word.Reset()
+				inWord = false
+			}
+		} else {
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+
+	if inSingleQuote || inDoubleQuote {
+		return nil, Errorf("unterminated quote in %q", s)
+	}
+
+	if inWord {
+		ret = append(ret, word.String())
+	}
+
+	return ret, nil
+}
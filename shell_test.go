@@ -0,0 +1,98 @@
+package x
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "''"},
+		{"abc", "abc"},
+		{"/etc/app.conf", "/etc/app.conf"},
+		{"user@host:22", "user@host:22"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"a;rm -rf /", "'a;rm -rf /'"},
+		{"$HOME", "'$HOME'"},
+		{"line\nbreak", "'line\nbreak'"},
+		{"''", `''\'''\'''`},
+	}
+
+	for _, test := range tests {
+		if got := ShellQuote(test.in); got != test.want {
+			t.Errorf("ShellQuote(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestShellQuoteRoundTrip(t *testing.T) {
+	words := []string{
+		"", "plain", "with space", "it's", "'", "''", "a;b", "a && b", "$(id)",
+		"`id`", "line\nbreak", "tab\there", `back\slash`, `"double"`, "*?[]",
+	}
+
+	for _, word := range words {
+		got, err := ShellSplit(ShellQuote(word))
+		if err != nil {
+			t.Errorf("ShellSplit(ShellQuote(%q)): %v", word, err)
+		} else if !slices.Equal(got, []string{word}) {
+			t.Errorf("ShellSplit(ShellQuote(%q)) = %q", word, got)
+		}
+	}
+
+	args := []any{}
+	for _, word := range words {
+		args = append(args, word)
+	}
+	got, err := ShellSplit(ShellArgs(args...))
+	if err != nil {
+		t.Fatalf("ShellSplit(ShellArgs(...)): %v", err)
+	} else if !slices.Equal(got, words) {
+		t.Fatalf("ShellSplit(ShellArgs(...)) = %q, want %q", got, words)
+	}
+}
+
+func TestShellSplit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"ls -l /tmp", []string{"ls", "-l", "/tmp"}},
+		{"  a \t b\nc  ", []string{"a", "b", "c"}},
+		{"echo 'a b' c", []string{"echo", "a b", "c"}},
+		{`echo "a b" c`, []string{"echo", "a b", "c"}},
+		{"echo ''", []string{"echo", ""}},
+		{`echo ""`, []string{"echo", ""}},
+		{`echo a\ b`, []string{"echo", "a b"}},
+		{`echo 'it'\''s'`, []string{"echo", "it's"}},
+		{`echo "it's"`, []string{"echo", "it's"}},
+		{`echo "a\"b\\c\$d\e"`, []string{"echo", `a"b\c$d\e`}},
+		{`echo 'a\b'`, []string{"echo", `a\b`}},
+		{"echo a;b", []string{"echo", "a;b"}},
+		{"echo 'a\nb'", []string{"echo", "a\nb"}},
+		{`echo x"y"'z'`, []string{"echo", "xyz"}},
+	}
+
+	for _, test := range tests {
+		got, err := ShellSplit(test.in)
+		if err != nil {
+			t.Errorf("ShellSplit(%q): %v", test.in, err)
+		} else if !slices.Equal(got, test.want) {
+			t.Errorf("ShellSplit(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestShellSplitError(t *testing.T) {
+	for _, in := range []string{"echo 'a", `echo "a`, `echo a\`, `echo "a\"`} {
+		if got, err := ShellSplit(in); err == nil {
+			t.Errorf("ShellSplit(%q) = %q, want an error", in, got)
+		}
+	}
+}
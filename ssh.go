@@ -1,13 +1,20 @@
 package x
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -21,30 +28,81 @@ type SSHConfig struct {
 	PrivateKey   string
 	SSHTimeoutMS uint32
 	SCPTimeoutMS uint32
-}
 
-// progressWriter wraps an io.Writer and reports progress
-type scpProgressWriter struct {
-	writer     io.Writer
-	total      int64
-	current    int64
-	lastUpdate time.Time
-	onProgress func(current, total int64)
+	// SudoPassword is sent to sudo by SudoSSH when it asks for a password,
+	// defaults to Password
+	SudoPassword string
+
+	// CommandTimeoutMS limits how long a single SSH or SudoSSH command may
+	// run, 0 means no limit
+	CommandTimeoutMS uint32
+
+	// PrivateKeyPassphrase decrypts PrivateKey when it is encrypted
+	PrivateKeyPassphrase string
+	// Certificate is the path or content of an OpenSSH certificate for
+	// PrivateKey, defaults to PrivateKey + "-cert.pub" when that file exists
+	Certificate string
+	// UseAgent offers the keys of the ssh-agent at AgentSocket, which
+	// defaults to $SSH_AUTH_SOCK
+	UseAgent    bool
+	AgentSocket string
+
+	// HostKeyPolicy defaults to SSHHostKeyPinned when HostKeyFingerprints is
+	// set and to SSHHostKeyAcceptNew otherwise
+	HostKeyPolicy       SSHHostKeyPolicy
+	KnownHostsFile      string   // defaults to ~/.ssh/known_hosts
+	HostKeyFingerprints []string // SHA256:... or MD5:... fingerprints
+
+	// TransferMode selects the protocol of SCPFile and SCPBytes, defaults to SSHTransferAuto
+	TransferMode SSHTransferMode
+
+	// KeepaliveIntervalMS sends keepalive@openssh.com requests on the open
+	// connection, 0 disables keepalives
+	KeepaliveIntervalMS uint32
+	// KeepaliveCountMax is how many keepalives in a row may go unanswered
+	// before the connection is closed as dead, defaults to 3
+	KeepaliveCountMax uint32
+	// ReconnectRetry is how many times a dead connection is redialed with
+	// backoff before the next command, defaults to 3, negative disables
+	ReconnectRetry int
+
+	// JumpHosts are the bastions to tunnel through, in order from the local
+	// side, each with its own auth. JumpHosts of the jump hosts are ignored.
+	JumpHosts []SSHConfig
 }
 
-func (pw *scpProgressWriter) Write(p []byte) (int, error) {
-	n, err := pw.writer.Write(p)
-	pw.current += int64(n)
+// SSHTransferMode selects the protocol used for file transfers
+type SSHTransferMode string
 
-	// Update progress at most 10 times per second to avoid flooding the terminal
-	if time.Since(pw.lastUpdate) > 100*time.Millisecond {
-		pw.onProgress(pw.current, pw.total)
-		pw.lastUpdate = time.Now()
-	}
+const (
+	// SSHTransferAuto uses sftp and falls back to scp when the server has no sftp subsystem
+	SSHTransferAuto SSHTransferMode = "auto"
+	SSHTransferSFTP SSHTransferMode = "sftp"
+	SSHTransferSCP  SSHTransferMode = "scp"
+)
 
-	return n, err
+// SSHTransferOptions configures a single transfer
+type SSHTransferOptions struct {
+	// Progress receives the status of the transfer, nil uses the progress
+	// of the SSHClient
+	Progress TransferProgress
+	// Checksum makes SCPFile compare the sha256 of the local file with
+	// sha256sum of the uploaded temp file before it is moved in place
+	Checksum bool
+	// Resume makes SCPFile keep the temp file of an interrupted upload and
+	// continue it from its remote size on the next upload of the same local
+	// file to the same remote path
+	Resume bool
 }
 
+// sshCancelGrace is how long a canceled command waits for its remaining
+// output after the session was closed
+const sshCancelGrace = 2 * time.Second
+
+// sftpResumeWindow is rewritten when an sftp upload is resumed, pipelined
+// writes that were in flight when the upload died may have left holes
+const sftpResumeWindow = sftpMaxInflight * sftpChunkSize
+
 type newlineWriter struct {
 	writer    io.Writer
 	firstData bool
@@ -85,10 +143,14 @@ func newSSHOutput(useExpect bool) *sshOutput {
 }
 
 func (p *sshOutput) Write(data []byte) (n int, err error) {
+	// stdout and stderr are copied into the output concurrently
+	p.mu.Lock()
 	n, err = p.buf.Write(data)
+	content := p.buf.String()
+	p.mu.Unlock()
 
 	if ch := p.GetChangeCH(); ch != nil {
-		p.contentChangeCH <- p.buf.String()
+		ch <- content
 	}
 
 	return n, err
@@ -129,10 +191,125 @@ func (p *sshOutput) WaitChange() (string, error) {
 	}
 }
 
+// markerWriter removes markers the remote command prints from the output
+// written through it and calls their callback for every occurrence
+type markerWriter struct {
+	writer  io.Writer
+	markers map[string]func()
+	pending []byte
+	mu      *sync.Mutex
+}
+
+func newMarkerWriter(writer io.Writer, markers map[string]func()) *markerWriter {
+	return &markerWriter{
+		writer:  writer,
+		markers: markers,
+		mu:      &sync.Mutex{},
+	}
+}
+
+func (p *markerWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buf := append(p.pending, data...)
+	p.pending = nil
+
+	for {
+		index, found := -1, ""
+		for marker := range p.markers {
+			if i := bytes.Index(buf, []byte(marker)); i >= 0 && (index < 0 || i < index) {
+				index, found = i, marker
+			}
+		}
+		if index < 0 {
+			break
+		}
+
+		if _, err := p.writer.Write(buf[:index]); err != nil {
+			return len(data), err
+		}
+		buf = buf[index+len(found):]
+		p.markers[found]()
+	}
+
+	// keep a partial marker at the end until the next write
+	keep := 0
+	for marker := range p.markers {
+		for i := Min(len(buf), len(marker)-1); i > keep; i-- {
+			if strings.HasPrefix(marker, string(buf[len(buf)-i:])) {
+				keep = i
+				break
+			}
+		}
+	}
+	p.pending = append([]byte{}, buf[len(buf)-keep:]...)
+
+	if _, err := p.writer.Write(buf[:len(buf)-keep]); err != nil {
+		return len(data), err
+	}
+	return len(data), nil
+}
+
+// flush writes what was kept as a partial marker
+func (p *markerWriter) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pending) > 0 {
+		_, _ = p.writer.Write(p.pending)
+		p.pending = nil
+	}
+}
+
+// sshStdin serializes the writes of the input, the expect callback and the
+// sudo password to the stdin of a session and its close
+type sshStdin struct {
+	writer io.WriteCloser
+	closed bool
+	mu     *sync.Mutex
+}
+
+func newSSHStdin(writer io.WriteCloser) *sshStdin {
+	return &sshStdin{writer: writer, mu: &sync.Mutex{}}
+}
+
+func (p *sshStdin) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, io.EOF
+	}
+	return p.writer.Write(data)
+}
+
+func (p *sshStdin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	return p.writer.Close()
+}
+
+func (p *sshStdin) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
 type SSHResult struct {
-	stdout string
-	stderr string
-	err    error
+	stdout   string
+	stderr   string
+	err      error
+	host     string
+	command  string
+	exitCode int
+	signal   string
+	duration time.Duration
 }
 
 func (p *SSHResult) IsSuccess() bool {
@@ -163,6 +340,33 @@ func (p *SSHResult) Error() error {
 	return p.err
 }
 
+// ExitCode returns the exit code of the command, 128 + the signal number
+// when it was killed by a signal, -1 when the command did not exit
+func (p *SSHResult) ExitCode() int {
+	return p.exitCode
+}
+
+// Signal returns the name of the signal that killed the command, like TERM,
+// or an empty string
+func (p *SSHResult) Signal() string {
+	return p.signal
+}
+
+// Duration returns how long the command ran
+func (p *SSHResult) Duration() time.Duration {
+	return p.duration
+}
+
+// Command returns the command as it was sent, including sudo
+func (p *SSHResult) Command() string {
+	return p.command
+}
+
+// Host returns the host the command ran on
+func (p *SSHResult) Host() string {
+	return p.host
+}
+
 // SSHClient is a client for SSH connections
 type SSHClient struct {
 	config     SSHConfig
@@ -172,11 +376,30 @@ type SSHClient struct {
 	stderr     io.Writer
 	sshTimeout time.Duration
 	scpTimeout time.Duration
+	cmdTimeout time.Duration
 	sshTempDir string
+	progress   TransferProgress
 	auth       []ssh.AuthMethod
+	signers    []ssh.Signer
+	noSFTP     atomic.Bool
+	quiet      bool       // only the output of commands is written, used by SSHGroup
+	jump       *SSHClient // last jump host, nil when dialing directly
+	forwards   map[*SSHForward]struct{}
+	forwardsMu *sync.Mutex
 	runMu      *sync.Mutex
+	outputMu   *sync.Mutex // serializes the output of concurrent commands
 	errorsMu   *sync.Mutex
 	errors     []error
+	cmdOptions *SSHCommandOptions
+	dryRun     SSHDryRunMode
+	plan       *SSHPlan // changes recorded in dry-run mode
+
+	keepaliveInterval time.Duration
+	keepaliveCountMax int
+	reconnectRetry    int
+	sessionSlots      chan struct{}              // one element per open session
+	runDone           chan struct{}              // closed when runClient is dead
+	liveClient        atomic.Pointer[ssh.Client] // runClient for forwards, read without runMu
 }
 
 // NewSSHClient creates a new SSHClient
@@ -189,22 +412,33 @@ func NewSSHClient(config SSHConfig) *SSHClient {
 		sshTimeout: time.Second * 60,
 		scpTimeout: time.Second * 600,
 		sshTempDir: "/tmp",
+		progress:   NewTTYProgress(),
 		auth:       []ssh.AuthMethod{},
+		forwards:   map[*SSHForward]struct{}{},
+		forwardsMu: &sync.Mutex{},
 		runMu:      &sync.Mutex{},
+		outputMu:   &sync.Mutex{},
 		errorsMu:   &sync.Mutex{},
 		errors:     []error{},
+		plan:       newSSHPlan(),
+
+		sessionSlots:      make(chan struct{}, sshMaxSessions),
+		keepaliveCountMax: 3,
+		reconnectRetry:    3,
 	}
 
 	if ret.config.Port == 0 {
 		ret.config.Port = 22
 	}
 
-	if ret.config.Password != "" {
-		ret.auth = append(ret.auth, ssh.Password(ret.config.Password))
-	}
+	ret.jump = newJumpClient(ret.config.JumpHosts)
 
 	if ret.config.PrivateKey != "" {
-		ret.AuthPrivateKey(ret.config.PrivateKey)
+		ret.AuthPrivateKeyWithPassphrase(ret.config.PrivateKey, ret.config.PrivateKeyPassphrase)
+	}
+
+	if ret.config.Certificate != "" {
+		ret.AuthCertificate(ret.config.Certificate)
 	}
 
 	if ret.config.SSHTimeoutMS > 0 {
@@ -215,6 +449,22 @@ func NewSSHClient(config SSHConfig) *SSHClient {
 		ret.scpTimeout = time.Duration(ret.config.SCPTimeoutMS) * time.Millisecond
 	}
 
+	if ret.config.CommandTimeoutMS > 0 {
+		ret.cmdTimeout = time.Duration(ret.config.CommandTimeoutMS) * time.Millisecond
+	}
+
+	if ret.config.KeepaliveIntervalMS > 0 {
+		ret.keepaliveInterval = time.Duration(ret.config.KeepaliveIntervalMS) * time.Millisecond
+	}
+
+	if ret.config.KeepaliveCountMax > 0 {
+		ret.keepaliveCountMax = int(ret.config.KeepaliveCountMax)
+	}
+
+	if ret.config.ReconnectRetry != 0 {
+		ret.reconnectRetry = ret.config.ReconnectRetry
+	}
+
 	return ret
 }
 
@@ -271,7 +521,35 @@ func (p *SSHClient) SetStderr(stderr io.Writer) *SSHClient {
 	return p
 }
 
-// SetExpect sets the expect function for the SSHClient
+// printf prints what the SSHClient is doing unless it is quiet
+func (p *SSHClient) printf(color string, format string, a ...any) {
+	if !p.quiet {
+		ColorPrintf(color, format, a...)
+	}
+}
+
+// SetTransferProgress sets the default progress of uploads and downloads,
+// nil disables progress reporting
+func (p *SSHClient) SetTransferProgress(progress TransferProgress) *SSHClient {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	p.progress = Ternary[TransferProgress](progress != nil, progress, NopProgress{})
+	return p
+}
+
+// transferProgress returns the progress of options or the default progress
+func (p *SSHClient) transferProgress(options *SSHTransferOptions) TransferProgress {
+	if options != nil && options.Progress != nil {
+		return options.Progress
+	}
+
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	return p.progress
+}
+
+// SetExpect sets the expect function for the SSHClient, SSHWithExpect
+// answers the prompts of a single command with an expect script
 func (p *SSHClient) SetExpect(expect func(output string) (string, error)) *SSHClient {
 	p.runMu.Lock()
 	defer p.runMu.Unlock()
@@ -297,7 +575,18 @@ func (p *SSHClient) SetSSHTimeout(timeout time.Duration) *SSHClient {
 	return p
 }
 
-// SetSCPTimeout sets the timeout for the SCP connection
+// SetCommandTimeout limits how long a single SSH or SudoSSH command may
+// run, 0 means no limit
+func (p *SSHClient) SetCommandTimeout(timeout time.Duration) *SSHClient {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	p.cmdTimeout = timeout
+	return p
+}
+
+// SetSCPTimeout sets the timeout for the connection of transfers, sftp and
+// scp transfers are also stopped once they made no progress for it
 func (p *SSHClient) SetSCPTimeout(timeout time.Duration) *SSHClient {
 	p.runMu.Lock()
 	defer p.runMu.Unlock()
@@ -325,6 +614,13 @@ func (p *SSHClient) AuthKeyboardInteractive(callback ssh.KeyboardInteractiveChal
 
 // AuthPrivateKey adds a private key authentication method to the SSHClient
 func (p *SSHClient) AuthPrivateKey(privateKey string) *SSHClient {
+	return p.AuthPrivateKeyWithPassphrase(privateKey, "")
+}
+
+// AuthPrivateKeyWithPassphrase adds an encrypted private key authentication
+// method to the SSHClient. When privateKey is a file and privateKey + "-cert.pub"
+// exists, the certificate is added as well.
+func (p *SSHClient) AuthPrivateKeyWithPassphrase(privateKey string, passphrase string) *SSHClient {
 	p.runMu.Lock()
 	defer p.runMu.Unlock()
 
@@ -332,30 +628,69 @@ func (p *SSHClient) AuthPrivateKey(privateKey string) *SSHClient {
 		panic("client is already open")
 	}
 
-	privateKeyPath := privateKey
-	if strings.HasPrefix(privateKeyPath, "~/") {
-		privateKeyPath = filepath.Join(os.Getenv("HOME"), privateKeyPath[2:])
-	}
-
 	// if privateKey as file exists, read the file
-	if fileInfo, err := os.Stat(privateKeyPath); err == nil && !fileInfo.IsDir() {
-		if v, err := os.ReadFile(privateKeyPath); err != nil {
-			p.setError(err)
-			return p
-		} else {
-			privateKey = string(v)
-		}
+	content, isFile, err := readKeyFile(privateKey)
+	if err != nil {
+		p.setError(err)
+		return p
 	}
 
-	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	signer, err := parsePrivateKey(content, passphrase)
 	if err != nil {
 		p.setError(err)
 		return p
 	}
-	p.auth = append(p.auth, ssh.PublicKeys(signer))
+	p.signers = append(p.signers, signer)
+
+	if !isFile {
+		return p
+	} else if content, err := os.ReadFile(expandHomePath(privateKey) + "-cert.pub"); err != nil {
+		return p
+	} else if cert, err := parseCertificate(content); err != nil {
+		p.setError(err)
+	} else if certSigner, err := ssh.NewCertSigner(cert, signer); err != nil {
+		p.setError(err)
+	} else {
+		p.signers = append(p.signers, certSigner)
+	}
 	return p
 }
 
+// dial opens a new connection to the configured host
+func (p *SSHClient) dial(timeout time.Duration) (*ssh.Client, error) {
+	hostKeyCallback, hostKeyAlgorithms, err := p.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, closeAuth, err := p.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAuth()
+
+	address := net.JoinHostPort(p.config.Host, Sprintf("%d", p.config.Port))
+	config := &ssh.ClientConfig{
+		User:              p.config.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           timeout,
+	}
+
+	var client *ssh.Client
+	if p.jump != nil {
+		client, err = p.dialJump(address, config, timeout)
+	} else {
+		client, err = ssh.Dial("tcp", address, config)
+	}
+	if err != nil {
+		return nil, Errorf("failed to dial: %s@%s:%d : %w", p.config.User, p.config.Host, p.config.Port, err)
+	}
+
+	return client, nil
+}
+
 func (p *SSHClient) OpenWithRetry(retry int) error {
 	p.runMu.Lock()
 	defer p.runMu.Unlock()
@@ -382,26 +717,21 @@ func (p *SSHClient) OpenWithRetry(retry int) error {
 	var retError error
 
 	for range retry {
-		if client, err := ssh.Dial(
-			"tcp",
-			net.JoinHostPort(p.config.Host, Sprintf("%d", p.config.Port)),
-			&ssh.ClientConfig{
-				User:            p.config.User,
-				Auth:            p.auth,
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-				Timeout:         p.sshTimeout,
-			},
-		); err != nil {
-			retError = Errorf("failed to dial: %s@%s:%d : %v", p.config.User, p.config.Host, p.config.Port, err)
+		if client, err := p.dial(p.sshTimeout); err != nil {
+			retError = err
+			if errors.As(err, new(*SSHHostKeyError)) {
+				p.setError(err)
+				break
+			}
 			time.Sleep(time.Second * 1)
 			continue
 		} else {
-			p.runClient = client
+			p.setRunClient(client)
 			return nil
 		}
 	}
 
-	p.setError(retError)
+	// the host may be reachable again later, only host key errors stay
 	return retError
 }
 
@@ -424,44 +754,49 @@ func (p *SSHClient) Open() error {
 		return reportErr
 	}
 
-	if client, err := ssh.Dial(
-		"tcp",
-		net.JoinHostPort(p.config.Host, Sprintf("%d", p.config.Port)),
-		&ssh.ClientConfig{
-			User:            p.config.User,
-			Auth:            p.auth,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         p.sshTimeout,
-		},
-	); err != nil {
-		reportErr := Errorf("failed to dial: %s@%s:%d : %v", p.config.User, p.config.Host, p.config.Port, err)
-		p.setError(reportErr)
-		return reportErr
+	// the host may be reachable again later, only host key errors stay
+	if client, err := p.dial(p.sshTimeout); err != nil {
+		if errors.As(err, new(*SSHHostKeyError)) {
+			p.setError(err)
+		}
+		return err
 	} else {
-		p.runClient = client
+		p.setRunClient(client)
 		return nil
 	}
 }
 
 func (p *SSHClient) Close() error {
+	p.closeForwards()
+
 	p.runMu.Lock()
 	defer p.runMu.Unlock()
 
+	// a connection that is already closed, by the server or a former
+	// Close, is not an error and the jump host is closed anyway
+	var ret error
 	if p.runClient != nil {
-		ret := p.runClient.Close()
-		if ret != nil {
-			return ret
-		} else {
-			p.runClient = nil
-			return nil
+		dead := p.isRunClientDead()
+		if err := p.runClient.Close(); err != nil && !dead && !errors.Is(err, net.ErrClosed) {
+			ret = err
+		}
+		p.runClient = nil
+		p.liveClient.Store(nil)
+	}
+
+	if p.jump != nil {
+		if err := p.jump.Close(); err != nil && ret == nil {
+			ret = err
 		}
-	} else {
-		return nil
 	}
+
+	return ret
 }
 
 func (p *SSHClient) RemoteHomeDir() (string, error) {
-	if result := p.SSH("echo $HOME"); result.IsSuccess() {
+	if err := p.stubbedProbe("home directory"); err != nil {
+		return "", err
+	} else if result := p.SSHWithOptions(sshProbeOptions, "echo $HOME"); result.IsSuccess() {
 		return result.Stdout(), nil
 	} else {
 		return "", result.Error()
@@ -469,121 +804,200 @@ func (p *SSHClient) RemoteHomeDir() (string, error) {
 }
 
 func (p *SSHClient) SudoSSH(format string, args ...any) *SSHResult {
+	return p.SudoSSHContext(context.Background(), format, args...)
+}
+
+// SSHWithInput runs the command with input streamed into its stdin, stdin
+// is closed when input reaches EOF
+func (p *SSHClient) SSHWithInput(input io.Reader, format string, args ...any) *SSHResult {
+	return p.ssh(context.Background(), false, nil, input, nil, format, args...)
+}
+
+// SudoSSHWithInput is SudoSSH with input streamed into the stdin of the
+// command once sudo accepted the password
+func (p *SSHClient) SudoSSHWithInput(input io.Reader, format string, args ...any) *SSHResult {
+	return p.ssh(context.Background(), p.config.User != "root", nil, input, nil, format, args...)
+}
+
+func (p *SSHClient) SSH(format string, args ...any) *SSHResult {
+	return p.SSHContext(context.Background(), format, args...)
+}
+
+// SudoSSHContext is SudoSSH that stops the command when ctx is done
+func (p *SSHClient) SudoSSHContext(ctx context.Context, format string, args ...any) *SSHResult {
 	if p.config.User == "root" {
-		return p.ssh(false, format, args...)
+		return p.ssh(ctx, false, nil, nil, nil, format, args...)
 	} else {
-		return p.ssh(true, format, args...)
+		return p.ssh(ctx, true, nil, nil, nil, format, args...)
 	}
 }
 
-func (p *SSHClient) SSH(format string, args ...any) *SSHResult {
-	return p.ssh(false, format, args...)
+// SSHContext is SSH that stops the command when ctx is done. The remote
+// process gets a TERM signal, the session is closed and the result has an
+// SSHTimeoutError with the output collected so far.
+func (p *SSHClient) SSHContext(ctx context.Context, format string, args ...any) *SSHResult {
+	return p.ssh(ctx, false, nil, nil, nil, format, args...)
 }
 
 // SSH executes a command on the SSHClient
-func (p *SSHClient) ssh(sudo bool, format string, args ...any) *SSHResult {
+func (p *SSHClient) ssh(
+	ctx context.Context, sudo bool, options *SSHCommandOptions, input io.Reader, expect *SSHExpect,
+	format string, args ...any,
+) *SSHResult {
+	// runMu is only held to read the settings and to open the session, so
+	// commands run concurrently on the connection
 	p.runMu.Lock()
-	defer p.runMu.Unlock()
+	options = p.commandOptions(options)
+	command, sudo, err := p.buildCommand(Sprintf(format, args...), sudo, options, false, input != nil)
+	cmdTimeout, clientExpect := p.cmdTimeout, p.expect
+	clientStdout, clientStderr := p.stdout, p.stderr
+	dryRun := p.dryRun
+	p.runMu.Unlock()
+
+	if err != nil {
+		return p.newSSHResult(Sprintf(format, args...), err)
+	}
+
+	// dry-run mode only records changes, read-only commands are stubbed or
+	// run as set by SetDryRun
+	if dryRun != SSHDryRunOff && (!options.ReadOnly || dryRun == SSHDryRunStubProbes) {
+		return p.dryRunCommand(command, sudo, options.ReadOnly, input != nil)
+	}
 
 	if err := p.getLastError(); err != nil {
-		return &SSHResult{
-			err: err,
-		}
+		return p.newSSHResult(command, err)
 	}
 
-	if p.runClient == nil {
-		reportErr := Errorf("client is not open")
-		p.setError(reportErr)
-		return &SSHResult{
-			err: reportErr,
-		}
+	if cmdTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmdTimeout)
+		defer cancel()
 	}
 
-	command := Sprintf(format, args...)
-	if sudo {
-		command = Sprintf("sudo -S %s", command)
+	release, err := p.acquireSession(ctx)
+	if err == nil {
+		defer release()
+		err = ctx.Err()
+	}
+	if err != nil {
+		return p.newSSHResult(command, &SSHTimeoutError{Host: p.config.Host, Command: command, Err: err})
 	}
 
-	session, err := p.runClient.NewSession()
+	session, err := p.openSession()
 	if err != nil {
-		reportErr := Errorf("failed to create session: %v", err)
-		p.setError(reportErr)
-		return &SSHResult{
-			err: reportErr,
-		}
+		return p.newSSHResult(command, err)
 	}
 	defer session.Close()
 
-	stdin, err := session.StdinPipe()
+	stdinPipe, err := session.StdinPipe()
 	if err != nil {
-		reportErr := Errorf("error creating stdin pipe: %v", err)
-		p.setError(reportErr)
-		return &SSHResult{
-			err: reportErr,
-		}
+		reportErr := &SSHConnectionError{Host: p.config.Host, Err: Errorf("error creating stdin pipe: %v", err)}
+		return p.newSSHResult(command, reportErr)
 	}
+	stdin := newSSHStdin(stdinPipe)
 	defer stdin.Close()
 
 	stdout, err := session.StdoutPipe()
 	if err != nil {
-		reportErr := Errorf("error creating stdout pipe: %v", err)
-		p.setError(reportErr)
-		return &SSHResult{
-			err: reportErr,
-		}
+		reportErr := &SSHConnectionError{Host: p.config.Host, Err: Errorf("error creating stdout pipe: %v", err)}
+		return p.newSSHResult(command, reportErr)
 	}
 	stderr, err := session.StderrPipe()
 	if err != nil {
-		reportErr := Errorf("error creating stderr pipe: %v", err)
-		p.setError(reportErr)
-		return &SSHResult{
-			err: reportErr,
-		}
+		reportErr := &SSHConnectionError{Host: p.config.Host, Err: Errorf("error creating stderr pipe: %v", err)}
+		return p.newSSHResult(command, reportErr)
 	}
 
 	outCH := make(chan error, 2)
 	inCH := make(chan error, 1)
-	outBuffer := bytes.NewBuffer(nil)
-	errBuffer := bytes.NewBuffer(nil)
-	expectOutput := newSSHOutput(p.expect != nil)
+	outBuffer := newSSHOutput(false)
+	errBuffer := newSSHOutput(false)
+	expectOutput := newSSHOutput(clientExpect != nil || expect != nil)
 
 	// build stdout
 	outWriters := []io.Writer{outBuffer, expectOutput}
-	if p.stdout != nil {
-		outWriters = append(outWriters, WrapNewLineWriter(p.stdout))
+	if clientStdout != nil {
+		writer := &lockedWriter{writer: clientStdout, mu: p.outputMu}
+		outWriters = append(outWriters, Ternary(p.quiet, io.Writer(writer), WrapNewLineWriter(writer)))
 	}
 	useStdout := io.MultiWriter(outWriters...)
 
 	// build stderr
 	errWriters := []io.Writer{errBuffer, expectOutput}
-	if p.stderr != nil {
-		errWriters = append(errWriters, WrapNewLineWriter(p.stderr))
+	if clientStderr != nil {
+		writer := &lockedWriter{writer: clientStderr, mu: p.outputMu}
+		errWriters = append(errWriters, Ternary(p.quiet, io.Writer(writer), WrapNewLineWriter(writer)))
 	}
 	useStdErr := io.MultiWriter(errWriters...)
 
+	finished := make(chan struct{})
+	defer close(finished)
+	stopSession := func() {
+		_ = session.Close()
+	}
+
+	// the markers printed by sudo and the command are kept out of the output
+	markers := map[string]func(){}
+
+	// answer the password prompt of sudo
+	var prompter *sudoPrompter
+	if sudo && p.sudoPassword() != "" {
+		prompter = newSudoPrompter(stdin, p.sudoPassword(), stopSession)
+		markers[sshSudoPrompt] = prompter.onPrompt
+	}
+
+	// with sudo the input must wait until sudo read the password, the
+	// command prints sshInputReady after sudo succeeded
+	inputReady := make(chan struct{})
+	if input != nil && sudo {
+		markers[sshInputReady] = sync.OnceFunc(func() {
+			close(inputReady)
+		})
+	} else {
+		close(inputReady)
+	}
+
+	var marked *markerWriter
+	if len(markers) > 0 {
+		marked = newMarkerWriter(useStdErr, markers)
+		useStdErr = marked
+	}
+
 	go func() {
-		if p.expect != nil {
-			for {
-				outputStr, err := expectOutput.WaitChange()
-				if err != nil {
-					inCH <- err
-					return
+		err := io.EOF
+		if expect != nil {
+			err = expect.run(expectOutput, stdin)
+		} else if clientExpect != nil {
+			for err == io.EOF {
+				outputStr, waitErr := expectOutput.WaitChange()
+				if waitErr != nil {
+					break
 				}
 
-				if input, err := p.expect(outputStr); err != nil {
-					inCH <- err
-					return
-				} else if input != "" {
-					if _, err := Fprint(stdin, input); err != nil {
-						inCH <- err
-						return
+				if answer, expectErr := clientExpect(outputStr); expectErr != nil {
+					err = expectErr
+				} else if answer != "" {
+					if _, writeErr := Fprint(stdin, answer); writeErr != nil && !stdin.isClosed() {
+						err = writeErr
 					}
 				} else {
 					continue
 				}
 			}
 		} else {
-			inCH <- io.EOF
+			Ignore()
+		}
+		inCH <- err
+
+		// a failed expect stops the command, the output still has to be
+		// read until it is closed
+		if err != io.EOF {
+			stopSession()
+			for {
+				if _, err := expectOutput.WaitChange(); err != nil {
+					return
+				}
+			}
 		}
 	}()
 
@@ -597,59 +1011,174 @@ func (p *SSHClient) ssh(sudo bool, format string, args ...any) *SSHResult {
 		outCH <- err
 	}()
 
-	ColorPrintf("purple", "%s@%s: ", p.config.User, p.config.Host)
-	ColorPrintf("blue", "%s", command)
+	// servers only accept the variables allowed by AcceptEnv, export the
+	// others with the command
+	if !sudo && len(options.Env) > 0 && !setenv(session, options) {
+		command, _, _ = p.buildCommand(Sprintf(format, args...), false, options, true, input != nil)
+	}
 
-	retError := session.Run(command)
+	p.printf("purple", "%s@%s: ", p.config.User, p.config.Host)
+	p.printf("blue", "%s", command)
 
-	for range 2 {
-		if err := <-outCH; err != nil && err != io.EOF {
-			retError = err
+	startTime := time.Now()
+	if err := session.Start(command); err != nil {
+		return p.newSSHResult(command, &SSHConnectionError{Host: p.config.Host, Err: err})
+	}
+
+	waitCH := make(chan error, 1)
+	go func() {
+		waitCH <- session.Wait()
+	}()
+
+	inputCH := make(chan error, 1)
+	if input != nil {
+		go func() {
+			select {
+			case <-inputReady:
+			case <-finished:
+				return
+			}
+
+			// writing to a closed session fails with io.EOF, other errors
+			// come from the reader and stop the command
+			if _, err := io.Copy(stdin, input); err != nil && err != io.EOF {
+				inputCH <- err
+				stopSession()
+			}
+			_ = stdin.Close()
+		}()
+	}
+
+	var runError error
+	var timeoutError error
+	var grace <-chan time.Time
+	select {
+	case runError = <-waitCH:
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGTERM)
+		_ = session.Close()
+		timeoutError = &SSHTimeoutError{Host: p.config.Host, Command: command, Err: ctx.Err()}
+		// the connection may be dead, only wait a moment for the output
+		grace = time.After(sshCancelGrace)
+	}
+	duration := time.Since(startTime)
+
+	var copyError error
+	outputDone := 0
+	for waiting := true; waiting && outputDone < 2; {
+		select {
+		case err := <-outCH:
+			if err != nil && err != io.EOF {
+				copyError = err
+			}
+			outputDone++
+		case <-grace:
+			waiting = false
+		}
+	}
+
+	var expectError error
+	if outputDone == 2 {
+		if marked != nil {
+			marked.flush()
+		}
+		expectOutput.Close()
+		if err := <-inCH; err != nil && err != io.EOF {
+			expectError = err
 		}
+	} else {
+		go func(pending int) {
+			for range pending {
+				<-outCH
+			}
+			expectOutput.Close()
+		}(2 - outputDone)
 	}
 
-	expectOutput.Close()
+	ret := p.newSSHResult(command, nil)
+	ret.stdout = strings.TrimSpace(outBuffer.String())
+	ret.stderr = strings.TrimSpace(errBuffer.String())
+	ret.duration = duration
+
+	var inputError error
+	select {
+	case inputError = <-inputCH:
+	default:
+	}
 
-	if err := <-inCH; err != nil && err != io.EOF {
-		retError = err
+	var exitError *ssh.ExitError
+	if timeoutError != nil {
+		Ignore()
+	} else if runError == nil {
+		ret.exitCode = 0
+	} else if errors.As(runError, &exitError) {
+		ret.exitCode, ret.signal = exitError.ExitStatus(), exitError.Signal()
+	} else {
+		Ignore()
+	}
+
+	if timeoutError != nil {
+		ret.err = timeoutError
+	} else if prompter != nil && prompter.passwordError() != nil {
+		ret.err = &SSHSudoError{Host: p.config.Host, Command: command, Err: prompter.passwordError()}
+	} else if inputError != nil {
+		ret.err = Errorf("failed to read input: %w", inputError)
+	} else if expectError != nil {
+		ret.err = &SSHExpectError{Host: p.config.Host, Command: command, Err: expectError}
+	} else if exitError != nil {
+		ret.err = &SSHExitError{
+			Host:     p.config.Host,
+			Command:  command,
+			ExitCode: ret.exitCode,
+			Signal:   ret.signal,
+			Err:      exitError,
+		}
+	} else if runError != nil {
+		ret.err = &SSHConnectionError{Host: p.config.Host, Err: runError}
+	} else if copyError != nil {
+		ret.err = &SSHConnectionError{Host: p.config.Host, Err: copyError}
+	} else {
+		Ignore()
 	}
 
-	if retError != nil {
-		if p.stderr == nil {
+	if ret.err != nil {
+		if p.quiet {
+			Ignore()
+		} else if clientStderr == nil {
 			ColorPrintf("red", "\n✗ failed\n")
 		} else if !strings.HasSuffix(expectOutput.String(), "\n") {
 			Print("\n")
 		} else {
 			Ignore()
 		}
-
-		return &SSHResult{
-			stdout: strings.TrimSpace(outBuffer.String()),
-			stderr: strings.TrimSpace(errBuffer.String()),
-			err:    retError,
-		}
 	} else {
-		if p.stdout == nil {
+		if p.quiet {
+			Ignore()
+		} else if clientStdout == nil {
 			ColorPrintf("green", "\n✔ ok\n")
 		} else if !strings.HasSuffix(outBuffer.String(), "\n") {
 			Print("\n")
 		} else {
 			Ignore()
 		}
-
-		return &SSHResult{
-			stdout: strings.TrimSpace(outBuffer.String()),
-			stderr: strings.TrimSpace(errBuffer.String()),
-			err:    nil,
-		}
 	}
+
+	return ret
 }
 
-// SCP uploads a file to the SSHClient
-func (p *SSHClient) scp(localPath string, remotePath string) error {
-	p.runMu.Lock()
-	defer p.runMu.Unlock()
+// newSSHResult creates the result of a command that did not exit
+func (p *SSHClient) newSSHResult(command string, err error) *SSHResult {
+	return &SSHResult{
+		err:      err,
+		host:     p.config.Host,
+		command:  command,
+		exitCode: -1,
+	}
+}
 
+// scp uploads size bytes of reader to the SSHClient, name is shown in the
+// output and the progress
+func (p *SSHClient) scp(reader io.Reader, size int64, name string, remotePath string, progress TransferProgress) (err error) {
 	if p.config.User == "" {
 		return Errorf("user is empty")
 	}
@@ -657,38 +1186,23 @@ func (p *SSHClient) scp(localPath string, remotePath string) error {
 		return Errorf("host is empty")
 	}
 
-	if strings.HasPrefix(localPath, "~/") {
-		localPath = filepath.Join(os.Getenv("HOME"), localPath[2:])
-	}
-
-	file, err := os.Open(localPath)
-	if err != nil {
-		return Errorf("failed to open local file %s: %v", localPath, err)
-	}
-	defer file.Close()
-
-	stat, err := file.Stat()
-	if err != nil {
-		return Errorf("failed to stat local file %s: %v", localPath, err)
-	}
-	fileSize := stat.Size()
 	fileName := filepath.Base(remotePath) // Use the base of remotePath as the filename
 
-	client, err := ssh.Dial(
-		"tcp",
-		net.JoinHostPort(p.config.Host, Sprintf("%d", p.config.Port)),
-		&ssh.ClientConfig{
-			User:            p.config.User,
-			Auth:            p.auth,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         p.scpTimeout,
-		},
-	)
+	client, err := p.transferDial()
 	if err != nil {
-		return Errorf("failed to dial: %s@%s:%d : %v", p.config.User, p.config.Host, p.config.Port, err)
+		return err
 	}
 	defer client.Close()
 
+	// abort the transfer once it made no progress for the scp timeout
+	idle := newTransferIdle(p.scpTimeout, func() {
+		_ = client.Close()
+	})
+	defer idle.Stop()
+	defer func() {
+		err = idle.check(name, err)
+	}()
+
 	session, err := client.NewSession()
 	if err != nil {
 		return Errorf("failed to create session: %w", err)
@@ -705,112 +1219,578 @@ func (p *SSHClient) scp(localPath string, remotePath string) error {
 		return Errorf("failed to get stdout pipe: %w", err)
 	}
 
+	// the protocol runs while the session is waited for, its error is
+	// more telling than the exit status of scp
+	sendCH := make(chan error, 1)
 	go func() {
 		defer stdin.Close() // Crucial to close stdin to signal EOF to remote scp
+		sendCH <- scpSend(
+			stdin, bufio.NewReader(io.TeeReader(stdout, idle)), io.TeeReader(reader, idle),
+			size, name, fileName, progress,
+		)
+	}()
 
-		// SCP protocol:
-		// 1. Send 'C' mode size filename\n
-		//    Example: C0644 123 example.txt\n
-		//    Mode 0644 is common for files.
-		_, _ = Fprintf(stdin, "C0644 %d %s\n", fileSize, fileName)
+	remoteTargetDir := filepath.Dir(remotePath)
+	cmd := Sprintf("scp -t %s", ShellQuote(remoteTargetDir))
+	p.printf("blue", "scp %s ", name)
+	p.printf("purple", "%s@%s:", p.config.User, p.config.Host)
+	p.printf("blue", "%s\n", remotePath)
 
-		// Check for acknowledgment (a null byte) from remote scp
-		ack := make([]byte, 1)
-		_, err := stdout.Read(ack)
-		if err != nil {
-			LogErrorf("Error reading initial ack from remote scp: %v (stdout may contain error message)", err)
-			// Attempt to read more for an error message from scp
-			errMsg := make([]byte, 512)
-			n, _ := stdout.Read(errMsg)
-			if n > 0 {
-				LogErrorf("Remote scp stdout/stderr: %s", string(errMsg[:n]))
-			}
-			return // Don't proceed if ack fails
-		}
-		if ack[0] != 0 {
-			LogErrorf("Remote scp sent non-zero ack: %d. Error on remote.", ack[0])
-			// Attempt to read more for an error message from scp
-			errMsg := make([]byte, 512)
-			n, _ := stdout.Read(errMsg)
-			if n > 0 {
-				LogErrorf("Remote scp stdout/stderr: %s", string(errMsg[:n]))
-			}
-			return
-		}
+	// session.Run() blocks until command finishes.
+	// We need to use Start() because we are interacting with stdin/stdout.
+	err = session.Start(cmd)
+	if err != nil {
+		return Errorf("failed to start remote scp command '%s': %w", cmd, err)
+	}
 
-		// 2. Send file contents with progress tracking
-		progressWriter := &scpProgressWriter{
-			writer: stdin,
-			total:  fileSize,
-			onProgress: func(current, total int64) {
-				percentage := float64(current) / float64(total) * 100
-				ColorPrintf("cyan", "\rUploading: %.2f%% (%d/%d bytes)", percentage, current, total)
-			},
+	// Wait for the command to finish.
+	// This will also wait for the goroutine above to complete its work with stdin/stdout.
+	err = session.Wait()
+	if sendErr := <-sendCH; sendErr != nil {
+		return sendErr
+	} else if err != nil {
+		// Check if it's an ExitError to get more details
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			return Errorf("remote scp command failed with exit status %d: %w", exitErr.ExitStatus(), err)
 		}
+		return Errorf("remote scp command failed: %w", err)
+	} else {
+		return nil
+	}
+}
 
-		copied, err := io.Copy(progressWriter, file)
-		// Always show 100% at the end
-		ColorPrintf("green", "\rUploading: 100.00%% (%d/%d bytes)", fileSize, fileSize)
-		ColorPrintf("green", " - Finished!\n")
+// scpSend sends size bytes of reader as fileName with the sink side of the
+// scp protocol, stdout is the output of the remote scp
+func scpSend(
+	stdin io.Writer, stdout *bufio.Reader, reader io.Reader, size int64,
+	name string, fileName string, progress TransferProgress,
+) error {
+	// SCP protocol:
+	// 1. Wait for the null byte of the remote scp that it is ready
+	// 2. Send 'C' mode size filename\n and wait for the ack
+	//    Example: C0644 123 example.txt\n
+	//    Mode 0644 is common for files.
+	// 3. Send the file contents and a null byte, wait for the final ack
+	if err := scpReadAck(stdout); err != nil {
+		return err
+	} else if _, err := Fprintf(stdin, "C0644 %d %s\n", size, fileName); err != nil {
+		return Errorf("failed to write to remote scp: %w", err)
+	} else if err := scpReadAck(stdout); err != nil {
+		return err
+	} else {
+		Ignore()
+	}
 
-		if err != nil {
-			LogErrorf("Error copying file contents to remote stdin: %v", err)
-			return
-		}
-		if copied != fileSize {
-			LogErrorf("Copied %d bytes, but expected %d bytes", copied, fileSize)
-			return
+	tracker := newTransferTracker(progress, TransferUpload, name, size)
+
+	if copied, err := io.Copy(io.MultiWriter(stdin, tracker), io.LimitReader(reader, size)); err != nil {
+		return Errorf("failed to copy file contents to remote scp: %w", err)
+	} else if copied != size {
+		return Errorf("copied %d bytes, but expected %d bytes", copied, size)
+	} else if _, err := stdin.Write([]byte{0}); err != nil {
+		return Errorf("failed to write to remote scp: %w", err)
+	} else if err := scpReadAck(stdout); err != nil {
+		return err
+	} else {
+		tracker.finish()
+		return nil
+	}
+}
+
+// scpReadAck reads the null byte the remote scp acknowledges with, other
+// bytes are followed by its error message
+func scpReadAck(reader *bufio.Reader) error {
+	if ack, err := reader.ReadByte(); err != nil {
+		return Errorf("failed to read ack from remote scp: %w", err)
+	} else if ack != 0 {
+		line, _ := reader.ReadString('\n')
+		return scpRemoteError(line)
+	} else {
+		return nil
+	}
+}
+
+// sftpUpload uploads size bytes of reader to the SSHClient over the sftp
+// subsystem, a positive offset continues an interrupted upload of remotePath
+func (p *SSHClient) sftpUpload(
+	reader io.Reader, size int64, name string, remotePath string,
+	offset int64, progress TransferProgress,
+) error {
+	client, err := p.SFTP()
+	if err != nil {
+		if errors.Is(err, ErrSFTPUnavailable) {
+			p.noSFTP.Store(true)
 		}
+		return err
+	}
+	defer client.Close()
 
-		// 3. Send a null byte to indicate EOF for this file
-		_, _ = Fprint(stdin, "\x00")
+	// abort the transfer once it made no progress for the scp timeout
+	idle := newTransferIdle(p.scpTimeout, func() {
+		client.fail(Errorf("sftp upload made no progress for %s", p.scpTimeout))
+	})
+	defer idle.Stop()
 
-		// 4. Check for final acknowledgment
-		_, err = stdout.Read(ack)
-		if err != nil {
-			LogErrorf("Error reading final ack from remote scp: %v", err)
-			return
-		}
-		if ack[0] != 0 {
-			LogErrorf("Remote scp sent non-zero final ack: %d. Error on remote.", ack[0])
-			errMsg := make([]byte, 512)
-			n, _ := stdout.Read(errMsg)
-			if n > 0 {
-				LogErrorf("Remote scp stdout/stderr: %s", string(errMsg[:n]))
-			}
-			return
+	p.printf("blue", "sftp %s ", name)
+	p.printf("purple", "%s@%s:", p.config.User, p.config.Host)
+	p.printf("blue", "%s\n", remotePath)
+
+	offset = Max(0, offset-sftpResumeWindow)
+	remote, err := client.OpenFile(
+		remotePath, os.O_WRONLY|os.O_CREATE|Ternary(offset > 0, 0, os.O_TRUNC), 0644,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+		_ = remote.Close()
+		return err
+	} else if err := seekUpload(reader, name, offset); err != nil {
+		_ = remote.Close()
+		return err
+	}
+
+	tracker := newTransferTracker(progress, TransferUpload, name, size)
+	tracker.resume(offset)
+
+	upload := io.TeeReader(io.LimitReader(reader, size-offset), io.MultiWriter(tracker, idle))
+	if copied, err := remote.ReadFrom(upload); err != nil {
+		_ = remote.Close()
+		return Errorf("failed to upload %s: %w", name, err)
+	} else if copied != size-offset {
+		_ = remote.Close()
+		return Errorf("copied %d bytes, but expected %d bytes", copied, size-offset)
+	} else if err := remote.Close(); err != nil {
+		return err
+	} else {
+		tracker.finish()
+		return nil
+	}
+}
+
+// appendUpload appends reader from offset to remotePath with cat, scp
+// cannot write at an offset so it is used to resume scp uploads
+func (p *SSHClient) appendUpload(
+	reader io.Reader, size int64, name string, remotePath string,
+	offset int64, progress TransferProgress,
+) (err error) {
+	if err := seekUpload(reader, name, offset); err != nil {
+		return err
+	}
+	client, err := p.transferDial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// abort the transfer once it made no progress for the scp timeout
+	idle := newTransferIdle(p.scpTimeout, func() {
+		_ = client.Close()
+	})
+	defer idle.Stop()
+	defer func() {
+		err = idle.check(name, err)
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return Errorf("failed to get stdin pipe: %w", err)
+	}
+
+	cmd := Sprintf("cat >> %s", ShellQuote(remotePath))
+	p.printf("blue", "resume %s ", name)
+	p.printf("purple", "%s@%s:", p.config.User, p.config.Host)
+	p.printf("blue", "%s\n", remotePath)
+
+	if err := session.Start(cmd); err != nil {
+		return Errorf("failed to start remote command '%s': %w", cmd, err)
+	}
+
+	tracker := newTransferTracker(progress, TransferUpload, name, size)
+	tracker.resume(offset)
+
+	if copied, err := io.Copy(io.MultiWriter(stdin, tracker, idle), io.LimitReader(reader, size-offset)); err != nil {
+		return Errorf("failed to upload %s: %w", name, err)
+	} else if copied != size-offset {
+		return Errorf("copied %d bytes, but expected %d bytes", copied, size-offset)
+	} else if err := stdin.Close(); err != nil {
+		return Errorf("failed to close remote stdin: %w", err)
+	} else if err := session.Wait(); err != nil {
+		return Errorf("remote command '%s' failed: %w", cmd, err)
+	} else {
+		tracker.finish()
+		return nil
+	}
+}
+
+// scpUpload uploads reader with scp, positive offsets append to remotePath
+func (p *SSHClient) scpUpload(
+	reader io.Reader, size int64, name string, remotePath string,
+	offset int64, progress TransferProgress,
+) error {
+	if offset > 0 {
+		return p.appendUpload(reader, size, name, remotePath, offset, progress)
+	}
+	return p.scp(reader, size, name, remotePath, progress)
+}
+
+// seekUpload moves reader to offset to resume an upload, only readers that
+// are io.Seekers can be resumed
+func seekUpload(reader io.Reader, name string, offset int64) error {
+	if offset == 0 {
+		return nil
+	} else if seeker, ok := reader.(io.Seeker); !ok {
+		return Errorf("failed to resume the upload of %s: reader is not seekable", name)
+	} else if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return Errorf("failed to seek %s: %w", name, err)
+	} else {
+		return nil
+	}
+}
+
+// upload copies a local file to remotePath with the configured transfer mode,
+// a positive offset continues an interrupted upload of remotePath
+func (p *SSHClient) upload(localPath string, remotePath string, offset int64, progress TransferProgress) error {
+	localPath = expandHomePath(localPath)
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return Errorf("failed to open local file %s: %v", localPath, err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return Errorf("failed to stat local file %s: %v", localPath, err)
+	}
+
+	return p.uploadReader(file, stat.Size(), localPath, remotePath, offset, progress)
+}
+
+// uploadReader copies size bytes of reader to remotePath with the configured
+// transfer mode, name is shown in the output and the progress
+func (p *SSHClient) uploadReader(
+	reader io.Reader, size int64, name string, remotePath string,
+	offset int64, progress TransferProgress,
+) error {
+	if p.dryRunMode() != SSHDryRunOff {
+		p.dryRunUpload(name, remotePath, size, offset)
+		return nil
+	}
+
+	switch mode := Ternary(p.config.TransferMode == "", SSHTransferAuto, p.config.TransferMode); mode {
+	case SSHTransferSCP:
+		return p.scpUpload(reader, size, name, remotePath, offset, progress)
+	case SSHTransferSFTP:
+		return p.sftpUpload(reader, size, name, remotePath, offset, progress)
+	case SSHTransferAuto:
+		// sftp is unavailable before anything was read from reader
+		if p.noSFTP.Load() {
+			return p.scpUpload(reader, size, name, remotePath, offset, progress)
+		} else if err := p.sftpUpload(reader, size, name, remotePath, offset, progress); errors.Is(err, ErrSFTPUnavailable) {
+			return p.scpUpload(reader, size, name, remotePath, offset, progress)
+		} else {
+			return err
 		}
+	default:
+		return Errorf("unknown transfer mode: %s", mode)
+	}
+}
+
+// scpDownload downloads a file from the SSHClient with the source side of the scp protocol
+func (p *SSHClient) scpDownload(remotePath string, writer io.Writer, progress TransferProgress) (err error) {
+	if p.config.User == "" {
+		return Errorf("user is empty")
+	}
+	if p.config.Host == "" {
+		return Errorf("host is empty")
+	}
+
+	client, err := p.transferDial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// abort the transfer once it made no progress for the scp timeout,
+	// everything the remote scp sends is progress
+	idle := newTransferIdle(p.scpTimeout, func() {
+		_ = client.Close()
+	})
+	defer idle.Stop()
+	defer func() {
+		err = idle.check(remotePath, err)
 	}()
 
-	remoteTargetDir := filepath.Dir(remotePath)
-	cmd := Sprintf("scp -t %s", remoteTargetDir)
-	ColorPrintf("blue", "scp %s ", localPath)
-	ColorPrintf("purple", "%s@%s:", p.config.User, p.config.Host)
-	ColorPrintf("blue", "%s\n", remotePath)
+	session, err := client.NewSession()
+	if err != nil {
+		return Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
 
-	// session.Run() blocks until command finishes.
-	// We need to use Start() because we are interacting with stdin/stdout.
-	err = session.Start(cmd)
+	stdin, err := session.StdinPipe()
 	if err != nil {
-		return Errorf("failed to start remote scp command '%s': %w", cmd, err)
+		return Errorf("failed to get stdin pipe: %w", err)
 	}
+	defer stdin.Close()
 
-	// Wait for the command to finish.
-	// This will also wait for the goroutine above to complete its work with stdin/stdout.
-	err = session.Wait()
+	stdout, err := session.StdoutPipe()
 	if err != nil {
-		// Check if it's an ExitError to get more details
+		return Errorf("failed to get stdout pipe: %w", err)
+	}
+	reader := bufio.NewReader(io.TeeReader(stdout, idle))
+
+	cmd := Sprintf("scp -f %s", ShellQuote(remotePath))
+	p.printf("blue", "scp ")
+	p.printf("purple", "%s@%s:", p.config.User, p.config.Host)
+	p.printf("blue", "%s\n", remotePath)
+
+	if err := session.Start(cmd); err != nil {
+		return Errorf("failed to start remote scp command '%s': %w", cmd, err)
+	}
+
+	// SCP protocol, source side:
+	// 1. Send a null byte to ask for the first file
+	// 2. Read 'C' mode size filename\n, 'T' time lines are acknowledged and skipped
+	// 3. Send a null byte and read size bytes of content
+	// 4. Read the null byte that ends the file and acknowledge it
+	fileSize := int64(-1)
+	if _, err := stdin.Write([]byte{0}); err != nil {
+		return Errorf("failed to write to remote scp: %w", err)
+	}
+
+	for fileSize < 0 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return Errorf("failed to read header from remote scp: %w", err)
+		}
+
+		switch line[0] {
+		case 'C':
+			var mode uint32
+			var name string
+			if _, err := Sscanf(line, "C%o %d %s", &mode, &fileSize, &name); err != nil {
+				return Errorf("invalid header from remote scp: %q", line)
+			}
+		case 'T':
+			Ignore()
+		case 1, 2:
+			return scpRemoteError(line[1:])
+		default:
+			return Errorf("unexpected header from remote scp: %q", line)
+		}
+
+		if _, err := stdin.Write([]byte{0}); err != nil {
+			return Errorf("failed to write to remote scp: %w", err)
+		}
+	}
+
+	tracker := newTransferTracker(progress, TransferDownload, remotePath, fileSize)
+
+	if _, err := io.CopyN(io.MultiWriter(writer, tracker), reader, fileSize); err != nil {
+		return Errorf("failed to read file contents from remote scp: %w", err)
+	}
+
+	if ack, err := reader.ReadByte(); err != nil {
+		return Errorf("failed to read final ack from remote scp: %w", err)
+	} else if ack != 0 {
+		line, _ := reader.ReadString('\n')
+		return scpRemoteError(line)
+	} else if _, err := stdin.Write([]byte{0}); err != nil {
+		return Errorf("failed to write to remote scp: %w", err)
+	} else {
+		_ = stdin.Close()
+	}
+
+	if err := session.Wait(); err != nil {
 		if exitErr, ok := err.(*ssh.ExitError); ok {
 			return Errorf("remote scp command failed with exit status %d: %w", exitErr.ExitStatus(), err)
 		}
 		return Errorf("remote scp command failed: %w", err)
 	}
 
+	tracker.finish()
 	return nil
 }
 
+// scpRemoteError converts an error message of the remote scp into an error
+func scpRemoteError(message string) error {
+	message = strings.TrimSpace(message)
+
+	if strings.Contains(message, "Permission denied") {
+		return Errorf("remote scp: %w: %s", os.ErrPermission, message)
+	} else if strings.Contains(message, "No such file") {
+		return Errorf("remote scp: %w: %s", os.ErrNotExist, message)
+	} else {
+		return Errorf("remote scp: %s", message)
+	}
+}
+
+// sftpDownload downloads a file from the SSHClient over the sftp subsystem
+func (p *SSHClient) sftpDownload(remotePath string, writer io.Writer, progress TransferProgress) error {
+	client, err := p.SFTP()
+	if err != nil {
+		if errors.Is(err, ErrSFTPUnavailable) {
+			p.noSFTP.Store(true)
+		}
+		return err
+	}
+	defer client.Close()
+
+	return p.sftpReceive(client, remotePath, writer, progress)
+}
+
+// sftpReceive copies a remote file into writer with an open sftp client
+func (p *SSHClient) sftpReceive(
+	client *SFTPClient, remotePath string, writer io.Writer,
+	progress TransferProgress,
+) error {
+	// abort the transfer once it made no progress for the scp timeout
+	idle := newTransferIdle(p.scpTimeout, func() {
+		client.fail(Errorf("sftp download made no progress for %s", p.scpTimeout))
+	})
+	defer idle.Stop()
+
+	p.printf("blue", "sftp ")
+	p.printf("purple", "%s@%s:", p.config.User, p.config.Host)
+	p.printf("blue", "%s\n", remotePath)
+
+	remote, err := client.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	info, err := remote.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	tracker := newTransferTracker(progress, TransferDownload, remotePath, fileSize)
+
+	if _, err := remote.WriteTo(io.MultiWriter(writer, tracker, idle)); err != nil {
+		return Errorf("failed to download %s: %w", remotePath, err)
+	}
+
+	tracker.finish()
+	return nil
+}
+
+// download copies a remote file into writer with the configured transfer mode
+func (p *SSHClient) download(remotePath string, writer io.Writer, progress TransferProgress) error {
+	switch mode := Ternary(p.config.TransferMode == "", SSHTransferAuto, p.config.TransferMode); mode {
+	case SSHTransferSCP:
+		return p.scpDownload(remotePath, writer, progress)
+	case SSHTransferSFTP:
+		return p.sftpDownload(remotePath, writer, progress)
+	case SSHTransferAuto:
+		if p.noSFTP.Load() {
+			return p.scpDownload(remotePath, writer, progress)
+		} else if err := p.sftpDownload(remotePath, writer, progress); errors.Is(err, ErrSFTPUnavailable) {
+			return p.scpDownload(remotePath, writer, progress)
+		} else {
+			return err
+		}
+	default:
+		return Errorf("unknown transfer mode: %s", mode)
+	}
+}
+
+// sudoDownload downloads a remote file, files the login user cannot read
+// are copied to the temp directory with sudo first
+func (p *SSHClient) sudoDownload(remotePath string, writer io.Writer, progress TransferProgress) error {
+	if err := p.stubbedProbe("download %s", remotePath); err != nil {
+		return err
+	} else if err := p.download(remotePath, writer, progress); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrPermission) || p.config.User == "root" {
+		return err
+	} else {
+		Ignore()
+	}
+
+	// the temp copy only serves the download, so it is made like a probe
+	tmpName := RandFileName(16) + ".tmp"
+	remoteTempPath := filepath.Join(p.sshTempDir, tmpName)
+	defer p.SudoSSHWithOptions(sshProbeOptions, "rm -f %s", ShellQuote(remoteTempPath))
+
+	if result := p.SudoSSHWithOptions(sshProbeOptions, "cp %s", ShellArgs(remotePath, remoteTempPath)); result.IsFailure() {
+		return result.Error()
+	} else if result := p.SudoSSHWithOptions(sshProbeOptions, "chown %s", ShellArgs(p.config.User, remoteTempPath)); result.IsFailure() {
+		return result.Error()
+	} else {
+		return p.download(remoteTempPath, writer, progress)
+	}
+}
+
+// DownloadFile downloads a remote file to localPath
+func (p *SSHClient) DownloadFile(remotePath string, localPath string) error {
+	return p.DownloadFileWithOptions(remotePath, localPath, nil)
+}
+
+// DownloadFileWithOptions downloads a remote file to localPath with per call options
+func (p *SSHClient) DownloadFileWithOptions(remotePath string, localPath string, options *SSHTransferOptions) error {
+	localPath = expandHomePath(localPath)
+
+	if err := p.stubbedProbe("download %s", remotePath); err != nil {
+		return err
+	}
+
+	// a failed download leaves an existing localPath untouched, the file is
+	// written next to it and renamed over it at the end
+	file, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".*.tmp")
+	if err != nil {
+		return Errorf("failed to create local file %s: %w", localPath, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(localPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err := p.sudoDownload(remotePath, file, p.transferProgress(options)); err != nil {
+		return err
+	} else if err := file.Chmod(mode); err != nil {
+		return Errorf("failed to write local file %s: %w", localPath, err)
+	} else if err := file.Close(); err != nil {
+		return Errorf("failed to write local file %s: %w", localPath, err)
+	} else if err := os.Rename(file.Name(), localPath); err != nil {
+		return Errorf("failed to write local file %s: %w", localPath, err)
+	} else {
+		return nil
+	}
+}
+
+// DownloadBytes downloads a remote file into memory
+func (p *SSHClient) DownloadBytes(remotePath string) ([]byte, error) {
+	return p.DownloadBytesWithOptions(remotePath, nil)
+}
+
+// DownloadBytesWithOptions downloads a remote file into memory with per call options
+func (p *SSHClient) DownloadBytesWithOptions(remotePath string, options *SSHTransferOptions) ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+
+	if err := p.sudoDownload(remotePath, buffer, p.transferProgress(options)); err != nil {
+		return nil, err
+	} else {
+		return buffer.Bytes(), nil
+	}
+}
+
 func (p *SSHClient) IsFileExists(filePath string) (bool, error) {
-	if result := p.SudoSSH("test -f %s && echo 'yes' || echo 'no'", filePath); result.IsSuccess() {
+	if p.stubProbes() {
+		return false, nil
+	} else if result := p.SudoSSHWithOptions(sshProbeOptions, "test -f %s && echo 'yes' || echo 'no'", ShellQuote(filePath)); result.IsSuccess() {
 		return result.Stdout() == "yes", nil
 	} else {
 		return false, result.Error()
@@ -818,7 +1798,10 @@ func (p *SSHClient) IsFileExists(filePath string) (bool, error) {
 }
 
 func (p *SSHClient) IsDirectoryExists(dirPath string) (bool, error) {
-	if result := p.SudoSSH("test -d %s && echo 'yes' || echo 'no'", dirPath); result.IsSuccess() {
+	if p.stubProbes() {
+		// only the root of the path exists
+		return filepath.Dir(dirPath) == dirPath, nil
+	} else if result := p.SudoSSHWithOptions(sshProbeOptions, "test -d %s && echo 'yes' || echo 'no'", ShellQuote(dirPath)); result.IsSuccess() {
 		return result.Stdout() == "yes", nil
 	} else {
 		return false, result.Error()
@@ -846,11 +1829,11 @@ func (p *SSHClient) CreateDirectory(dirPath string, user string, group string, m
 		}
 
 		// create directory
-		if result := p.SudoSSH("mkdir -p %s", dirPath); result.IsFailure() {
+		if result := p.SudoSSHWithOptions(sshHelperOptions, "mkdir -p %s", ShellQuote(dirPath)); result.IsFailure() {
 			return result.Error()
-		} else if result := p.SudoSSH("chown %s:%s %s", user, group, dirPath); result.IsFailure() {
+		} else if result := p.SudoSSHWithOptions(sshHelperOptions, "chown %s", ShellArgs(user+":"+group, dirPath)); result.IsFailure() {
 			return result.Error()
-		} else if result := p.SudoSSH("chmod %o %s", mode, dirPath); result.IsFailure() {
+		} else if result := p.SudoSSHWithOptions(sshHelperOptions, "chmod %o %s", mode, ShellQuote(dirPath)); result.IsFailure() {
 			return result.Error()
 		} else {
 			return nil
@@ -861,53 +1844,231 @@ func (p *SSHClient) CreateDirectory(dirPath string, user string, group string, m
 func (p *SSHClient) SCPFile(
 	localPath string, remotePath string,
 	user string, group string, mode os.FileMode,
+) error {
+	return p.SCPFileWithOptions(localPath, remotePath, user, group, mode, nil)
+}
+
+// SCPFileWithOptions is SCPFile with per call options
+func (p *SSHClient) SCPFileWithOptions(
+	localPath string, remotePath string,
+	user string, group string, mode os.FileMode,
+	options *SSHTransferOptions,
 ) error {
 	tmpName := RandFileName(16) + ".tmp"
+	offset := int64(0)
+
+	if options != nil && options.Resume {
+		if name, err := resumeTempName(localPath, remotePath); err != nil {
+			return err
+		} else {
+			tmpName = name
+		}
+	}
 	remoteTempPath := filepath.Join(p.sshTempDir, tmpName)
 
+	if options != nil && options.Resume {
+		if size, err := p.resumeOffset(localPath, remoteTempPath); err != nil {
+			return err
+		} else {
+			offset = size
+		}
+	}
+
+	localSum := func() (string, error) {
+		return fileSHA256(localPath)
+	}
+
 	if err := p.CreateDirectory(filepath.Dir(remotePath), user, group, 0755); err != nil {
 		return err
-	} else if err := p.scp(localPath, remoteTempPath); err != nil {
+	} else if err := p.upload(localPath, remoteTempPath, offset, p.transferProgress(options)); err != nil {
+		return err
+	} else if err := p.verifyUpload(localPath, localSum, remoteTempPath, options); err != nil {
 		return err
-	} else if result := p.SudoSSH("mv %s %s", remoteTempPath, remotePath); result.IsFailure() {
+	} else {
+		return p.installUpload(remoteTempPath, remotePath, user, group, mode)
+	}
+}
+
+// installUpload moves an uploaded temp file to remotePath and sets its
+// owner and mode
+func (p *SSHClient) installUpload(
+	remoteTempPath string, remotePath string,
+	user string, group string, mode os.FileMode,
+) error {
+	if result := p.SudoSSHWithOptions(sshHelperOptions, "mv %s", ShellArgs(remoteTempPath, remotePath)); result.IsFailure() {
 		return result.Error()
-	} else if result := p.SudoSSH("chown %s:%s %s", user, group, remotePath); result.IsFailure() {
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "chown %s", ShellArgs(user+":"+group, remotePath)); result.IsFailure() {
 		return result.Error()
-	} else if result := p.SudoSSH("chmod %o %s", mode, remotePath); result.IsFailure() {
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "chmod %o %s", mode, ShellQuote(remotePath)); result.IsFailure() {
 		return result.Error()
 	} else {
 		return nil
 	}
 }
 
-func (p *SSHClient) SCPBytes(
-	bytes []byte, remotePath string,
-	user string, group string, mode os.FileMode,
+// resumeTempName returns the temp file name of resumable uploads. It only
+// stays the same while the local file is unchanged.
+func resumeTempName(localPath string, remotePath string) (string, error) {
+	localPath, err := filepath.Abs(expandHomePath(localPath))
+	if err != nil {
+		return "", Errorf("failed to resolve local file %s: %w", localPath, err)
+	}
+
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return "", Errorf("failed to stat local file %s: %v", localPath, err)
+	}
+
+	sum := sha256.Sum256([]byte(Sprintf(
+		"%s\x00%s\x00%d\x00%d", localPath, remotePath, stat.Size(), stat.ModTime().UnixNano(),
+	)))
+	return Sprintf("%x.tmp", sum[:16]), nil
+}
+
+// resumeOffset returns the size of an interrupted upload in remoteTempPath,
+// 0 when there is nothing to resume
+func (p *SSHClient) resumeOffset(localPath string, remoteTempPath string) (int64, error) {
+	stat, err := os.Stat(expandHomePath(localPath))
+	if err != nil {
+		return 0, Errorf("failed to stat local file %s: %v", localPath, err)
+	}
+
+	if p.stubProbes() {
+		return 0, nil
+	}
+
+	result := p.SSHWithOptions(
+		sshProbeOptions, "if [ -f %s ]; then wc -c < %s; else echo 0; fi",
+		ShellQuote(remoteTempPath), ShellQuote(remoteTempPath),
+	)
+	if result.IsFailure() {
+		return 0, result.Error()
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(result.Stdout()), 10, 64)
+	if err != nil {
+		return 0, Errorf("invalid size of %s: %q", remoteTempPath, result.Stdout())
+	} else if size > stat.Size() {
+		// not a prefix of the local file, start over
+		return 0, nil
+	} else {
+		return size, nil
+	}
+}
+
+// fileSHA256 returns the hex sha256 of a local file
+func fileSHA256(localPath string) (string, error) {
+	file, err := os.Open(expandHomePath(localPath))
+	if err != nil {
+		return "", Errorf("failed to open local file %s: %v", localPath, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", Errorf("failed to read local file %s: %w", localPath, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyUpload compares the sha256 of the uploaded data of name, returned
+// by localSum, with the uploaded temp file when options ask for it.
+// A mismatching temp file is removed.
+func (p *SSHClient) verifyUpload(
+	name string, localSum func() (string, error),
+	remoteTempPath string, options *SSHTransferOptions,
 ) error {
-	tmpName := RandFileName(16) + ".tmp"
+	// nothing was uploaded in dry-run mode
+	if options == nil || !options.Checksum || p.dryRunMode() != SSHDryRunOff {
+		return nil
+	}
 
-	// write bytes to  file tmpName
-	tempFile, err := os.Create(tmpName)
+	sum, err := localSum()
 	if err != nil {
-		return Errorf("failed to create temp file: %w", err)
+		return err
+	}
+
+	if remoteSum, err := p.remoteSHA256(remoteTempPath); err != nil {
+		return err
+	} else if remoteSum != sum {
+		p.SSHWithOptions(sshHelperOptions, "rm -f %s", ShellQuote(remoteTempPath))
+		return Errorf(
+			"checksum mismatch for %s: local sha256 %s, remote sha256 %s",
+			name, sum, remoteSum,
+		)
+	} else {
+		return nil
 	}
-	defer tempFile.Close()
-	defer os.Remove(tmpName)
+}
+
+func (p *SSHClient) SCPBytes(
+	content []byte, remotePath string,
+	user string, group string, mode os.FileMode,
+) error {
+	return p.SCPBytesWithOptions(content, remotePath, user, group, mode, nil)
+}
+
+// SCPBytesWithOptions is SCPBytes with per call options
+func (p *SSHClient) SCPBytesWithOptions(
+	content []byte, remotePath string,
+	user string, group string, mode os.FileMode,
+	options *SSHTransferOptions,
+) error {
+	return p.UploadReaderWithOptions(
+		bytes.NewReader(content), int64(len(content)), remotePath, user, group, mode, options,
+	)
+}
+
+// UploadReader streams size bytes of reader into a remote temp file and
+// moves it to remotePath like SCPFile, nothing is written to local disk
+func (p *SSHClient) UploadReader(
+	reader io.Reader, size int64, remotePath string,
+	user string, group string, mode os.FileMode,
+) error {
+	return p.UploadReaderWithOptions(reader, size, remotePath, user, group, mode, nil)
+}
+
+// UploadReaderWithOptions is UploadReader with per call options. Checksum
+// hashes the data while it is streamed, Resume is not supported.
+func (p *SSHClient) UploadReaderWithOptions(
+	reader io.Reader, size int64, remotePath string,
+	user string, group string, mode os.FileMode,
+	options *SSHTransferOptions,
+) error {
+	remoteTempPath := filepath.Join(p.sshTempDir, RandFileName(16)+".tmp")
 
-	if _, err := tempFile.Write(bytes); err != nil {
-		return Errorf("failed to write bytes to temp file: %w", err)
+	hash := sha256.New()
+	localSum := func() (string, error) {
+		return hex.EncodeToString(hash.Sum(nil)), nil
 	}
 
-	return p.SCPFile(tmpName, remotePath, user, group, mode)
+	if err := p.CreateDirectory(filepath.Dir(remotePath), user, group, 0755); err != nil {
+		return err
+	} else if err := p.uploadReader(
+		io.TeeReader(reader, hash), size, remotePath, remoteTempPath, 0, p.transferProgress(options),
+	); err != nil {
+		return err
+	} else if err := p.verifyUpload(remotePath, localSum, remoteTempPath, options); err != nil {
+		return err
+	} else {
+		return p.installUpload(remoteTempPath, remotePath, user, group, mode)
+	}
 }
 
 // IsLinuxServiceEnabled checks if a service is enabled
 func (p *SSHClient) IsLinuxServiceEnabled(serviceName string) (bool, error) {
-	result := p.SudoSSH("systemctl is-enabled %s", serviceName)
+	if p.stubProbes() {
+		return false, nil
+	}
 
-	if result.StdoutContains("enabled") {
-		return true, nil
-	} else if result.StdoutContains("disabled") {
+	result := p.SudoSSHWithOptions(sshProbeOptions, "systemctl is-enabled %s", ShellQuote(serviceName))
+
+	// is-enabled prints the state, it also exits 0 for states like static
+	// or indirect that are not enabled. Unknown units print nothing on
+	// stdout.
+	if state := strings.TrimSpace(result.Stdout()); result.IsSuccess() {
+		return state == "enabled" || state == "enabled-runtime", nil
+	} else if IsSSHExitError(result.Error()) && state != "" {
 		return false, nil
 	} else {
 		return false, result.Error()
@@ -916,12 +2077,19 @@ func (p *SSHClient) IsLinuxServiceEnabled(serviceName string) (bool, error) {
 
 // IsLinuxServiceRunning checks if a service is running
 func (p *SSHClient) IsLinuxServiceRunning(serviceName string) (bool, error) {
-	result := p.SudoSSH("systemctl is-active %s", serviceName)
-
-	if result.StdoutContains("inactive") || result.StdoutContains("failed") {
+	if p.stubProbes() {
 		return false, nil
-	} else if result.StdoutContains("active") {
+	}
+
+	result := p.SudoSSHWithOptions(sshProbeOptions, "systemctl is-active %s", ShellQuote(serviceName))
+
+	// is-active exits 0 only when the unit is active and otherwise prints
+	// the state, exit code 3 is an inactive unit. Other failures, like sudo
+	// or a missing systemctl, print no state.
+	if result.IsSuccess() {
 		return true, nil
+	} else if IsSSHExitError(result.Error()) && (result.Stdout() != "" || result.ExitCode() == 3) {
+		return false, nil
 	} else {
 		return false, result.Error()
 	}
@@ -933,7 +2101,7 @@ func (p *SSHClient) StopLinuxService(serviceName string) error {
 		return err
 	} else if !running {
 		return nil
-	} else if result := p.SudoSSH("systemctl stop %s", serviceName); result.IsFailure() {
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "systemctl stop %s", ShellQuote(serviceName)); result.IsFailure() {
 		return result.Error()
 	} else {
 		return nil
@@ -946,7 +2114,7 @@ func (p *SSHClient) DisableLinuxService(serviceName string) error {
 		return err
 	} else if !enabled {
 		return nil
-	} else if result := p.SudoSSH("systemctl disable %s", serviceName); result.IsFailure() {
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "systemctl disable %s", ShellQuote(serviceName)); result.IsFailure() {
 		return result.Error()
 	} else {
 		return nil
@@ -959,7 +2127,7 @@ func (p *SSHClient) EnableLinuxService(serviceName string) error {
 		return err
 	} else if enabled {
 		return nil
-	} else if result := p.SudoSSH("systemctl enable %s", serviceName); result.IsFailure() {
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "systemctl enable %s", ShellQuote(serviceName)); result.IsFailure() {
 		return result.Error()
 	} else {
 		return nil
@@ -972,7 +2140,7 @@ func (p *SSHClient) StartLinuxService(serviceName string) error {
 		return err
 	} else if running {
 		return nil
-	} else if result := p.SudoSSH("systemctl start %s", serviceName); result.IsFailure() {
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "systemctl start %s", ShellQuote(serviceName)); result.IsFailure() {
 		return result.Error()
 	} else {
 		return nil
@@ -987,17 +2155,25 @@ func (p *SSHClient) DeployLinuxService(
 	serviceName := filepath.Base(serviceRemoteFilePath)
 
 	if len(strings.TrimSpace(serviceContent)) > 0 {
-		if err := p.SCPBytes([]byte(serviceContent), serviceRemoteFilePath, "root", "root", 0644); err != nil {
+		if err := p.UploadReader(
+			strings.NewReader(serviceContent), int64(len(serviceContent)),
+			serviceRemoteFilePath, "root", "root", 0644,
+		); err != nil {
 			return err
 		}
 	}
 
-	if result := p.SudoSSH("systemctl daemon-reload"); result.IsFailure() {
+	return p.restartLinuxService(serviceName)
+}
+
+// restartLinuxService reloads the units and restarts the service
+func (p *SSHClient) restartLinuxService(serviceName string) error {
+	if result := p.SudoSSHWithOptions(sshHelperOptions, "systemctl daemon-reload"); result.IsFailure() {
 		return result.Error()
 	} else if err := p.DisableLinuxService(serviceName); err != nil {
-		return result.Error()
+		return err
 	} else if err := p.EnableLinuxService(serviceName); err != nil {
-		return result.Error()
+		return err
 	} else if err := p.StopLinuxService(serviceName); err != nil {
 		return err
 	} else if err := p.StartLinuxService(serviceName); err != nil {
@@ -1007,8 +2183,50 @@ func (p *SSHClient) DeployLinuxService(
 	}
 }
 
+// DeployLinuxServiceIfChanged is DeployLinuxService that syncs the unit file
+// and only restarts the service when the unit file or one of the dependencies
+// changed, e.g. the result of syncing the service binary with SyncFile.
+// Otherwise it just makes sure the service is enabled and running.
+// It returns whether the service was restarted.
+func (p *SSHClient) DeployLinuxServiceIfChanged(
+	serviceContent string,
+	serviceRemoteFilePath string,
+	dependencies ...*SSHSyncResult,
+) (bool, error) {
+	serviceName := filepath.Base(serviceRemoteFilePath)
+	changed := false
+
+	if len(strings.TrimSpace(serviceContent)) > 0 {
+		if result, err := p.SyncBytes(
+			[]byte(serviceContent), serviceRemoteFilePath, "root", "root", 0644,
+		); err != nil {
+			return false, err
+		} else {
+			changed = result.Changed
+		}
+	}
+
+	for _, dependency := range dependencies {
+		if dependency != nil && dependency.Changed {
+			changed = true
+		}
+	}
+
+	if changed {
+		return true, p.restartLinuxService(serviceName)
+	} else if err := p.EnableLinuxService(serviceName); err != nil {
+		return false, err
+	} else if err := p.StartLinuxService(serviceName); err != nil {
+		return false, err
+	} else {
+		return false, nil
+	}
+}
+
 func (p *SSHClient) GetLinuxArch() (string, error) {
-	if result := p.SSH("uname -m"); result.IsFailure() {
+	if err := p.stubbedProbe("linux arch"); err != nil {
+		return "", err
+	} else if result := p.SSHWithOptions(sshProbeOptions, "uname -m"); result.IsFailure() {
 		return "", result.Error()
 	} else if result.StdoutContains("aarch64") || result.StdoutContains("arm64") {
 		return "arm64", nil
@@ -0,0 +1,162 @@
+package x
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// readKeyFile returns the content of key when it is a path to a file,
+// otherwise key itself
+func readKeyFile(key string) ([]byte, bool, error) {
+	keyPath := expandHomePath(key)
+
+	if fileInfo, err := os.Stat(keyPath); err != nil || fileInfo.IsDir() {
+		return []byte(key), false, nil
+	} else if v, err := os.ReadFile(keyPath); err != nil {
+		return nil, true, err
+	} else {
+		return v, true, nil
+	}
+}
+
+// parsePrivateKey parses a PEM or OpenSSH private key, encrypted keys need
+// the passphrase
+func parsePrivateKey(privateKey []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(passphrase))
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if errors.As(err, new(*ssh.PassphraseMissingError)) {
+		return nil, Errorf("private key is encrypted, PrivateKeyPassphrase is required: %w", err)
+	}
+	return signer, err
+}
+
+// parseCertificate parses an OpenSSH certificate in authorized_keys format
+func parseCertificate(certificate []byte) (*ssh.Certificate, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(certificate)
+	if err != nil {
+		return nil, Errorf("failed to parse certificate: %w", err)
+	}
+
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, Errorf("not an OpenSSH certificate: %s", publicKey.Type())
+	}
+	return cert, nil
+}
+
+// AuthCertificate adds an OpenSSH certificate authentication method to the
+// SSHClient. The certificate is used with the private key added before
+// whose public key it certifies.
+func (p *SSHClient) AuthCertificate(certificate string) *SSHClient {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	if p.runClient != nil {
+		panic("client is already open")
+	}
+
+	content, _, err := readKeyFile(certificate)
+	if err != nil {
+		p.setError(err)
+		return p
+	}
+
+	cert, err := parseCertificate(content)
+	if err != nil {
+		p.setError(err)
+		return p
+	}
+
+	for _, signer := range p.signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Marshal()) {
+			// already added next to its private key
+			return p
+		}
+	}
+
+	for _, signer := range p.signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			if certSigner, err := ssh.NewCertSigner(cert, signer); err != nil {
+				p.setError(err)
+			} else {
+				p.signers = append(p.signers, certSigner)
+			}
+			return p
+		}
+	}
+
+	p.setError(Errorf("no private key matches the certificate %s", cert.KeyId))
+	return p
+}
+
+// agentSigners connects to the ssh-agent and returns its keys. The
+// connection must stay open while the keys sign, close it after dialing.
+func (p *SSHClient) agentSigners() ([]ssh.Signer, func(), error) {
+	if !p.config.UseAgent {
+		return nil, func() {}, nil
+	}
+
+	socket := Ternary(p.config.AgentSocket != "", p.config.AgentSocket, os.Getenv("SSH_AUTH_SOCK"))
+	if socket == "" {
+		return nil, nil, Errorf("ssh-agent socket is not set, set AgentSocket or SSH_AUTH_SOCK")
+	}
+
+	conn, err := net.Dial("unix", expandHomePath(socket))
+	if err != nil {
+		return nil, nil, Errorf("failed to connect to ssh-agent %s: %w", socket, err)
+	}
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, Errorf("failed to list ssh-agent keys: %w", err)
+	}
+
+	return signers, func() { _ = conn.Close() }, nil
+}
+
+// authMethods builds the auth methods in the order they are tried:
+// publickey with certificates, private keys and ssh-agent keys,
+// then keyboard-interactive, then password
+func (p *SSHClient) authMethods() ([]ssh.AuthMethod, func(), error) {
+	agentSigners, closeAgent, err := p.agentSigners()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the ssh package tries every method only once, so all keys have to be
+	// offered by a single publickey method
+	signers := []ssh.Signer{}
+	for _, signer := range p.signers {
+		if _, ok := signer.PublicKey().(*ssh.Certificate); ok {
+			signers = append(signers, signer)
+		}
+	}
+	for _, signer := range p.signers {
+		if _, ok := signer.PublicKey().(*ssh.Certificate); !ok {
+			signers = append(signers, signer)
+		}
+	}
+	signers = append(signers, agentSigners...)
+
+	ret := []ssh.AuthMethod{}
+	if len(signers) > 0 {
+		ret = append(ret, ssh.PublicKeys(signers...))
+	}
+
+	ret = append(ret, p.auth...)
+
+	if p.config.Password != "" {
+		ret = append(ret, ssh.Password(p.config.Password))
+	}
+
+	return ret, closeAgent, nil
+}
@@ -0,0 +1,478 @@
+package x
+
+import (
+	"bufio"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sshConfigMaxDepth limits nested Include directives and ProxyJump hops
+const sshConfigMaxDepth = 16
+
+// sshConfigDefaultKeys are tried in order when no IdentityFile is set
+var sshConfigDefaultKeys = []string{
+	"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa",
+}
+
+// SSHConfigFromAlias builds an SSHConfig for alias from the OpenSSH client
+// config in ~/.ssh/config and /etc/ssh/ssh_config. It understands Include,
+// Host and Match host/originalhost/user/localuser/all blocks and the
+// keywords HostName, User, Port, IdentityFile, CertificateFile,
+// IdentityAgent, ProxyJump, ConnectTimeout, ServerAliveInterval,
+// ServerAliveCountMax, StrictHostKeyChecking and UserKnownHostsFile, others
+// are ignored. The first value of a keyword wins like in ssh, User
+// defaults to the local user. Unlike ssh, which tries every IdentityFile,
+// only the first IdentityFile that exists becomes PrivateKey and the others
+// are dropped. Like in ssh, the first jump host is reached through its own
+// ProxyJump, a ProxyJump to the host itself is ignored.
+//
+// The non-zero fields of explicit override the parsed values:
+//
+//	config, err := x.SSHConfigFromAlias("prod-db", x.SSHConfig{User: "deploy"})
+func SSHConfigFromAlias(alias string, explicit ...SSHConfig) (SSHConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return SSHConfig{}, Errorf("failed to find the home directory: %w", err)
+	}
+
+	return sshConfigFromFiles(
+		[]string{filepath.Join(home, ".ssh", "config"), "/etc/ssh/ssh_config"},
+		alias, explicit...,
+	)
+}
+
+// sshConfigFromFiles is SSHConfigFromAlias with the config files to read
+func sshConfigFromFiles(files []string, alias string, explicit ...SSHConfig) (SSHConfig, error) {
+	ret := SSHConfig{}
+	if len(explicit) > 0 {
+		ret = explicit[0]
+	}
+
+	parsed, err := parseSSHConfig(files, alias, ret.User, nil, true)
+	if err != nil {
+		return SSHConfig{}, err
+	}
+
+	ret.Host = Ternary(ret.Host != "", ret.Host, parsed.Host)
+	ret.User = Ternary(ret.User != "", ret.User, parsed.User)
+	ret.Port = Ternary(ret.Port != 0, ret.Port, parsed.Port)
+	ret.PrivateKey = Ternary(ret.PrivateKey != "", ret.PrivateKey, parsed.PrivateKey)
+	ret.Certificate = Ternary(ret.Certificate != "", ret.Certificate, parsed.Certificate)
+	ret.UseAgent = ret.UseAgent || parsed.UseAgent
+	ret.AgentSocket = Ternary(ret.AgentSocket != "", ret.AgentSocket, parsed.AgentSocket)
+	ret.HostKeyPolicy = Ternary(ret.HostKeyPolicy != "", ret.HostKeyPolicy, parsed.HostKeyPolicy)
+	ret.KnownHostsFile = Ternary(ret.KnownHostsFile != "", ret.KnownHostsFile, parsed.KnownHostsFile)
+	ret.SSHTimeoutMS = Ternary(ret.SSHTimeoutMS != 0, ret.SSHTimeoutMS, parsed.SSHTimeoutMS)
+	ret.KeepaliveIntervalMS = Ternary(ret.KeepaliveIntervalMS != 0, ret.KeepaliveIntervalMS, parsed.KeepaliveIntervalMS)
+	ret.KeepaliveCountMax = Ternary(ret.KeepaliveCountMax != 0, ret.KeepaliveCountMax, parsed.KeepaliveCountMax)
+	if len(ret.JumpHosts) == 0 {
+		ret.JumpHosts = parsed.JumpHosts
+	}
+
+	return ret, nil
+}
+
+// sshConfigParser collects the values of the blocks that apply to one host
+type sshConfigParser struct {
+	alias         string
+	user          string // user given by the caller, matched by Match user
+	localUser     string
+	home          string
+	values        map[string]string
+	identityFiles []string
+	certFiles     []string
+}
+
+// parseSSHConfig resolves alias with files, chain are the hosts that reach
+// alias through ProxyJump. The ProxyJump of alias is only followed with
+// follow.
+func parseSSHConfig(files []string, alias string, userName string, chain []string, follow bool) (SSHConfig, error) {
+	if len(chain) > sshConfigMaxDepth {
+		return SSHConfig{}, Errorf("ssh config: too many ProxyJump hops for %s", alias)
+	}
+
+	parser := &sshConfigParser{
+		alias:         alias,
+		user:          userName,
+		localUser:     os.Getenv("USER"),
+		home:          os.Getenv("HOME"),
+		values:        map[string]string{},
+		identityFiles: []string{},
+		certFiles:     []string{},
+	}
+	if current, err := user.Current(); err == nil {
+		parser.localUser = current.Username
+		parser.home = Ternary(parser.home != "", parser.home, current.HomeDir)
+	}
+
+	for _, file := range files {
+		if err := parser.parseFile(file, filepath.Dir(file), 0); err != nil {
+			return SSHConfig{}, err
+		}
+	}
+
+	return parser.config(files, chain, follow)
+}
+
+// parseFile reads the blocks of file, relative Include paths are resolved
+// in baseDir. Missing files are skipped.
+func (p *sshConfigParser) parseFile(file string, baseDir string, depth int) error {
+	if depth > sshConfigMaxDepth {
+		return Errorf("ssh config: too many nested Include in %s", file)
+	}
+
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return Errorf("ssh config: failed to read %s: %w", file, err)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	active := true
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyword, args, err := sshConfigLine(line)
+		if err != nil {
+			return Errorf("ssh config: %s:%d: %w", file, lineNumber, err)
+		} else if len(args) == 0 {
+			return Errorf("ssh config: %s:%d: missing argument for %s", file, lineNumber, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			active = p.matchHost(args)
+		case "match":
+			if active, err = p.matchCriteria(args); err != nil {
+				return Errorf("ssh config: %s:%d: %w", file, lineNumber, err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range args {
+				pattern = p.expandPath(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return Errorf("ssh config: %s:%d: %w", file, lineNumber, err)
+				}
+				for _, match := range matches {
+					if err := p.parseFile(match, baseDir, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		case "identityfile":
+			if active {
+				p.identityFiles = append(p.identityFiles, args[0])
+			}
+		case "certificatefile":
+			if active {
+				p.certFiles = append(p.certFiles, args[0])
+			}
+		default:
+			if _, ok := p.values[keyword]; active && !ok {
+				p.values[keyword] = strings.Join(args, " ")
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// sshConfigLine splits a line into its lower case keyword and arguments,
+// the keyword may be separated by "=" and arguments may be double quoted
+func sshConfigLine(line string) (string, []string, error) {
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), []string{}, nil
+	}
+
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	args := []string{}
+	for rest != "" {
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, Errorf("unterminated quote")
+			}
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+		} else if end := strings.IndexAny(rest, " \t"); end < 0 {
+			args = append(args, rest)
+			rest = ""
+		} else {
+			args = append(args, rest[:end])
+			rest = rest[end:]
+		}
+		rest = strings.TrimLeft(rest, " \t")
+	}
+
+	return keyword, args, nil
+}
+
+// matchHost reports whether the patterns of a Host line match the alias
+func (p *sshConfigParser) matchHost(patterns []string) bool {
+	return sshConfigMatchList(strings.Join(patterns, ","), p.alias)
+}
+
+// matchCriteria reports whether all criteria of a Match line apply,
+// criteria that cannot be checked here like exec never match
+func (p *sshConfigParser) matchCriteria(args []string) (bool, error) {
+	ret := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		matched := false
+		switch criterion {
+		case "all":
+			matched = true
+		case "canonical", "final":
+			matched = criterion == "final"
+		case "host", "originalhost", "user", "localuser", "exec", "localnetwork", "tagged":
+			if i+1 >= len(args) {
+				return false, Errorf("missing argument for Match %s", criterion)
+			}
+			i++
+
+			if criterion == "host" {
+				matched = sshConfigMatchList(args[i], p.hostName())
+			} else if criterion == "originalhost" {
+				matched = sshConfigMatchList(args[i], p.alias)
+			} else if criterion == "user" {
+				matched = sshConfigMatchList(args[i], p.userName())
+			} else if criterion == "localuser" {
+				matched = sshConfigMatchList(args[i], p.localUser)
+			} else {
+				matched = false
+			}
+		default:
+			return false, Errorf("unsupported Match criterion %q", criterion)
+		}
+
+		ret = ret && matched != negate
+	}
+
+	return ret, nil
+}
+
+// sshConfigMatchList matches value against a comma separated pattern list
+// with * and ? wildcards, a matching negated pattern rejects the value
+func sshConfigMatchList(list string, value string) bool {
+	ret := false
+	for _, pattern := range strings.Split(list, ",") {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		if !sshConfigMatchPattern(pattern, value) {
+			continue
+		} else if negate {
+			return false
+		} else {
+			ret = true
+		}
+	}
+	return ret
+}
+
+func sshConfigMatchPattern(pattern string, value string) bool {
+	expr := regexp.QuoteMeta(strings.ToLower(pattern))
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return regexp.MustCompile("^" + expr + "$").MatchString(strings.ToLower(value))
+}
+
+// hostName returns the HostName found so far, %h is the alias
+func (p *sshConfigParser) hostName() string {
+	if v, ok := p.values["hostname"]; ok {
+		return strings.ReplaceAll(v, "%h", p.alias)
+	}
+	return p.alias
+}
+
+// userName returns the user given by the caller or found so far
+func (p *sshConfigParser) userName() string {
+	if p.user != "" {
+		return p.user
+	} else if v, ok := p.values["user"]; ok {
+		return v
+	} else {
+		return p.localUser
+	}
+}
+
+// expandPath expands ~ and the tokens ssh allows in file names
+func (p *sshConfigParser) expandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = p.home + path[1:]
+	}
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", p.home,
+		"%u", p.localUser,
+		"%h", p.hostName(),
+		"%r", p.userName(),
+		"%p", Ternary(p.values["port"] != "", p.values["port"], "22"),
+	).Replace(path)
+}
+
+// config converts the collected values into an SSHConfig
+func (p *sshConfigParser) config(files []string, chain []string, follow bool) (SSHConfig, error) {
+	ret := SSHConfig{
+		Host: p.hostName(),
+		User: Ternary(p.values["user"] != "", p.values["user"], p.localUser),
+	}
+
+	if v, ok := p.values["port"]; ok {
+		if port, err := strconv.ParseUint(v, 10, 16); err != nil {
+			return SSHConfig{}, Errorf("ssh config: invalid Port %q for %s", v, p.alias)
+		} else {
+			ret.Port = uint16(port)
+		}
+	}
+
+	identityFiles := Ternary(len(p.identityFiles) > 0, p.identityFiles, sshConfigDefaultKeys)
+	for _, file := range identityFiles {
+		if file = p.expandPath(file); fileExists(file) {
+			ret.PrivateKey = file
+			break
+		}
+	}
+
+	for _, file := range p.certFiles {
+		if file = p.expandPath(file); fileExists(file) {
+			ret.Certificate = file
+			break
+		}
+	}
+
+	// the agent is only used when IdentityAgent asks for it, a stale
+	// SSH_AUTH_SOCK would make every dial fail
+	if v, ok := p.values["identityagent"]; !ok || strings.ToLower(v) == "none" {
+		Ignore()
+	} else if v == "SSH_AUTH_SOCK" {
+		ret.UseAgent = true
+	} else if strings.HasPrefix(v, "$") {
+		ret.UseAgent, ret.AgentSocket = true, os.Getenv(v[1:])
+	} else {
+		ret.UseAgent, ret.AgentSocket = true, p.expandPath(v)
+	}
+
+	if v, ok := p.values["stricthostkeychecking"]; ok {
+		switch strings.ToLower(v) {
+		case "yes", "ask":
+			ret.HostKeyPolicy = SSHHostKeyStrict
+		case "accept-new":
+			ret.HostKeyPolicy = SSHHostKeyAcceptNew
+		case "no", "off":
+			ret.HostKeyPolicy = SSHHostKeyInsecure
+		default:
+			return SSHConfig{}, Errorf("ssh config: invalid StrictHostKeyChecking %q for %s", v, p.alias)
+		}
+	}
+
+	if v, ok := p.values["userknownhostsfile"]; ok {
+		ret.KnownHostsFile = p.expandPath(strings.Fields(v)[0])
+	}
+
+	for _, item := range []struct {
+		keyword string
+		scale   uint32
+		target  *uint32
+	}{
+		{"connecttimeout", 1000, &ret.SSHTimeoutMS},
+		{"serveraliveinterval", 1000, &ret.KeepaliveIntervalMS},
+		{"serveralivecountmax", 1, &ret.KeepaliveCountMax},
+	} {
+		if v, ok := p.values[item.keyword]; !ok {
+			continue
+		} else if n, err := strconv.ParseUint(v, 10, 32); err != nil {
+			return SSHConfig{}, Errorf("ssh config: invalid %s %q for %s", item.keyword, v, p.alias)
+		} else {
+			*item.target = uint32(n) * item.scale
+		}
+	}
+
+	// the hops after the first are reached through the hops before them, so
+	// only the ProxyJump of the first one is followed
+	if v, ok := p.values["proxyjump"]; follow && ok && strings.ToLower(v) != "none" {
+		chain = append(slices.Clip(chain), p.alias)
+		for i, hop := range strings.Split(v, ",") {
+			if hops, err := parseSSHJump(files, strings.TrimSpace(hop), chain, i == 0); err != nil {
+				return SSHConfig{}, err
+			} else {
+				ret.JumpHosts = append(ret.JumpHosts, hops...)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// parseSSHJump resolves a ProxyJump hop [user@]host[:port] or
+// ssh://[user@]host[:port] of the last host of chain with the same config
+// files. It returns the jump hosts in order from the local side, those of
+// the hop when follow is set and then the hop itself.
+func parseSSHJump(files []string, hop string, chain []string, follow bool) ([]SSHConfig, error) {
+	hop = strings.TrimPrefix(hop, "ssh://")
+
+	userName, host, port := "", hop, uint16(0)
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		userName, host = host[:i], host[i+1:]
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		if n, err := strconv.ParseUint(host[i+1:], 10, 16); err != nil {
+			return nil, Errorf("ssh config: invalid ProxyJump port in %q", hop)
+		} else {
+			host, port = host[:i], uint16(n)
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	// like ssh, a ProxyJump to the host itself is ignored, a Host * block
+	// with ProxyJump also matches the jump host
+	isHost := func(alias string) bool {
+		return strings.EqualFold(alias, host)
+	}
+	if isHost(chain[len(chain)-1]) {
+		return nil, nil
+	} else if slices.ContainsFunc(chain, isHost) {
+		return nil, Errorf("ssh config: ProxyJump loop %s -> %s", strings.Join(chain, " -> "), host)
+	}
+
+	ret, err := parseSSHConfig(files, host, userName, chain, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	// SSHConfig has no jump hosts of jump hosts, they go before the hop
+	hops := ret.JumpHosts
+	ret.JumpHosts = nil
+	ret.User = Ternary(userName != "", userName, ret.User)
+	ret.Port = Ternary(port != 0, port, ret.Port)
+	return append(hops, ret), nil
+}
+
+func fileExists(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && !stat.IsDir()
+}
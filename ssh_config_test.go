@@ -0,0 +1,187 @@
+package x
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSSHConfigFromFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		alias string
+		want  string   // user@host:port
+		jumps []string // user@host:port of the jump hosts
+		key   string   // PrivateKey below the home directory
+		err   string
+	}{
+		{
+			name: "include",
+			files: map[string]string{
+				"config":           "Include conf.d/*.conf\n",
+				"conf.d/web.conf":  "Host web\n  HostName 10.0.0.1\n  User deploy\n",
+				"conf.d/skip.conf": "Host db\n  HostName 10.0.0.2\n",
+			},
+			alias: "web",
+			want:  "deploy@10.0.0.1:0",
+		},
+		{
+			name: "first value wins",
+			files: map[string]string{
+				"config": "Host web\n  Port 2222\nHost *\n  Port 22\n",
+			},
+			alias: "web",
+			want:  "ops@web:2222",
+		},
+		{
+			name: "host negation",
+			files: map[string]string{
+				"config": "Host * !bastion\n  ProxyJump bastion\nHost bastion\n  HostName 10.0.0.9\n",
+			},
+			alias: "bastion",
+			want:  "ops@10.0.0.9:0",
+		},
+		{
+			name: "host negation jumps",
+			files: map[string]string{
+				"config": "Host * !bastion\n  ProxyJump bastion\nHost bastion\n  HostName 10.0.0.9\n",
+			},
+			alias: "web",
+			want:  "ops@web:0",
+			jumps: []string{"ops@10.0.0.9:0"},
+		},
+		{
+			name: "match negation",
+			files: map[string]string{
+				"config": "Match host !*.internal\n  Port 2222\n",
+			},
+			alias: "db.internal",
+			want:  "ops@db.internal:0",
+		},
+		{
+			name: "match hostname",
+			files: map[string]string{
+				"config": "Host db\n  HostName db.internal\nMatch host *.internal !originalhost db\n  Port 2222\nMatch host *.internal\n  Port 2200\n",
+			},
+			alias: "db",
+			want:  "ops@db.internal:2200",
+		},
+		{
+			name: "tokens",
+			files: map[string]string{
+				"config":                      "Host web\n  HostName %h.example.com\n  User deploy\n  IdentityFile ~/.ssh/%r@%h\n",
+				".ssh/deploy@web.example.com": "",
+			},
+			alias: "web",
+			want:  "deploy@web.example.com:0",
+			key:   ".ssh/deploy@web.example.com",
+		},
+		{
+			name: "jump user and port",
+			files: map[string]string{
+				"config": "Host web\n  ProxyJump admin@bastion:2200\nHost bastion\n  User root\n  Port 22\n",
+			},
+			alias: "web",
+			want:  "ops@web:0",
+			jumps: []string{"admin@bastion:2200"},
+		},
+		{
+			name: "nested jump",
+			files: map[string]string{
+				"config": "Host a\n  ProxyJump b\nHost b\n  ProxyJump c\nHost c\n  HostName 10.0.0.3\n",
+			},
+			alias: "a",
+			want:  "ops@a:0",
+			jumps: []string{"ops@10.0.0.3:0", "ops@b:0"},
+		},
+		{
+			name: "only the first hop is followed",
+			files: map[string]string{
+				"config": "Host a\n  ProxyJump b,c\nHost b\n  ProxyJump d\nHost c\n  ProxyJump e\n",
+			},
+			alias: "a",
+			want:  "ops@a:0",
+			jumps: []string{"ops@d:0", "ops@b:0", "ops@c:0"},
+		},
+		{
+			name: "jump to itself",
+			files: map[string]string{
+				"config": "Host *\n  ProxyJump bastion\n",
+			},
+			alias: "web",
+			want:  "ops@web:0",
+			jumps: []string{"ops@bastion:0"},
+		},
+		{
+			name: "jump none",
+			files: map[string]string{
+				"config": "Host web\n  ProxyJump none\nHost *\n  ProxyJump bastion\n",
+			},
+			alias: "web",
+			want:  "ops@web:0",
+		},
+		{
+			name: "jump loop",
+			files: map[string]string{
+				"config": "Host a\n  ProxyJump b\nHost b\n  ProxyJump a\n",
+			},
+			alias: "a",
+			err:   "ProxyJump loop a -> b -> a",
+		},
+		{
+			name: "include loop",
+			files: map[string]string{
+				"config": "Include config\n",
+			},
+			alias: "a",
+			err:   "too many nested Include",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			for name, content := range test.files {
+				path := filepath.Join(home, name)
+				if name == "config" {
+					// the local user differs between machines
+					content += "Host *\n  User ops\n"
+				}
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				} else if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config, err := sshConfigFromFiles([]string{filepath.Join(home, "config")}, test.alias)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error with %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("sshConfigFromFiles: %v", err)
+			}
+
+			address := func(config SSHConfig) string {
+				return Sprintf("%s@%s:%d", config.User, config.Host, config.Port)
+			}
+			jumps := []string{}
+			for _, jump := range config.JumpHosts {
+				jumps = append(jumps, address(jump))
+			}
+
+			if got := address(config); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			} else if strings.Join(jumps, ",") != strings.Join(test.jumps, ",") {
+				t.Fatalf("got jump hosts %q, want %q", jumps, test.jumps)
+			} else if test.key != "" && config.PrivateKey != filepath.Join(home, test.key) {
+				t.Fatalf("got PrivateKey %s, want %s", config.PrivateKey, test.key)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package x
+
+import (
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SSHDirOptions configures UploadDir and DownloadDir
+type SSHDirOptions struct {
+	// Include only transfers files and symlinks whose relative path or base
+	// name matches one of the globs. Empty means every file.
+	Include []string
+	// Exclude skips files, symlinks and whole directories whose relative
+	// path or base name matches one of the globs.
+	Exclude []string
+	// Progress receives the status of the whole tree. When nil every file
+	// reports to the progress of the SSHClient on its own.
+	Progress TransferProgress
+}
+
+type sshDirEntryKind int
+
+const (
+	sshDirEntryDir sshDirEntryKind = iota
+	sshDirEntryFile
+	sshDirEntrySymlink
+)
+
+// sshDirEntry is an entry of a directory tree, relPath is slash separated
+type sshDirEntry struct {
+	kind    sshDirEntryKind
+	relPath string
+	size    int64
+	target  string
+}
+
+func matchDirGlobs(globs []string, relPath string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, relPath); ok {
+			return true
+		} else if ok, _ := path.Match(glob, path.Base(relPath)); ok {
+			return true
+		} else {
+			continue
+		}
+	}
+	return false
+}
+
+func (p *SSHDirOptions) skip(kind sshDirEntryKind, relPath string) bool {
+	if p == nil {
+		return false
+	} else if matchDirGlobs(p.Exclude, relPath) {
+		return true
+	} else if kind != sshDirEntryDir && len(p.Include) > 0 {
+		return !matchDirGlobs(p.Include, relPath)
+	} else {
+		return false
+	}
+}
+
+// dirTransfer reports the progress of single files as part of a whole tree
+type dirTransfer struct {
+	tracker  *transferTracker // nil when every file reports on its own
+	fallback TransferProgress
+	done     int64
+}
+
+func (p *SSHClient) newDirTransfer(
+	options *SSHDirOptions, direction TransferDirection, name string, total int64,
+) *dirTransfer {
+	if options == nil || options.Progress == nil {
+		return &dirTransfer{fallback: p.transferProgress(nil)}
+	}
+
+	return &dirTransfer{
+		tracker: newTransferTracker(options.Progress, direction, name, total),
+	}
+}
+
+// progress returns the progress for the next file
+func (p *dirTransfer) progress() TransferProgress {
+	if p.tracker == nil {
+		return p.fallback
+	}
+
+	done := p.done
+	return TransferProgressFunc(func(status TransferStatus) {
+		p.tracker.status.Done = done + status.Done
+		p.tracker.report()
+	})
+}
+
+// add marks size bytes as transferred once a file is complete
+func (p *dirTransfer) add(size int64) {
+	p.done += size
+}
+
+func (p *dirTransfer) finish() {
+	if p.tracker != nil {
+		p.tracker.status.Done = p.done
+		p.tracker.finish()
+	}
+}
+
+func walkLocalDir(localDir string, options *SSHDirOptions) ([]sshDirEntry, int64, error) {
+	ret := []sshDirEntry{}
+	total := int64(0)
+
+	err := filepath.WalkDir(localDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if filePath == localDir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(localDir, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case d.IsDir():
+			if options.skip(sshDirEntryDir, rel) {
+				return filepath.SkipDir
+			}
+			ret = append(ret, sshDirEntry{kind: sshDirEntryDir, relPath: rel})
+		case d.Type()&fs.ModeSymlink != 0:
+			if options.skip(sshDirEntrySymlink, rel) {
+				return nil
+			} else if target, err := os.Readlink(filePath); err != nil {
+				return err
+			} else {
+				ret = append(ret, sshDirEntry{kind: sshDirEntrySymlink, relPath: rel, target: target})
+			}
+		case d.Type().IsRegular():
+			if options.skip(sshDirEntryFile, rel) {
+				return nil
+			} else if info, err := d.Info(); err != nil {
+				return err
+			} else {
+				ret = append(ret, sshDirEntry{kind: sshDirEntryFile, relPath: rel, size: info.Size()})
+				total += info.Size()
+			}
+		default:
+			// sockets, devices and pipes are not transferred
+			Ignore()
+		}
+
+		return nil
+	})
+
+	return ret, total, err
+}
+
+// runBatched runs commands joined with && in batches to keep command lines short
+func (p *SSHClient) runBatched(commands []string, sudo bool) error {
+	const batchSize = 100
+
+	for start := 0; start < len(commands); start += batchSize {
+		batch := strings.Join(commands[start:Min(start+batchSize, len(commands))], " && ")
+		if sudo {
+			if result := p.SudoSSHWithOptions(sshHelperOptions, "%s", batch); result.IsFailure() {
+				return result.Error()
+			}
+		} else if result := p.SSHWithOptions(sshHelperOptions, "%s", batch); result.IsFailure() {
+			return result.Error()
+		} else {
+			Ignore()
+		}
+	}
+
+	return nil
+}
+
+// UploadDir uploads the local directory tree to remoteDir keeping relative
+// paths. Empty directories and symlinks are recreated, regular files get
+// user, group and mode like SCPFile, directories get mode 0755.
+func (p *SSHClient) UploadDir(
+	localDir string, remoteDir string,
+	user string, group string, mode os.FileMode,
+	options *SSHDirOptions,
+) error {
+	localDir = filepath.Clean(expandHomePath(localDir))
+
+	if info, err := os.Stat(localDir); err != nil {
+		return Errorf("failed to stat local directory %s: %w", localDir, err)
+	} else if !info.IsDir() {
+		return Errorf("%s is not a directory", localDir)
+	}
+
+	entries, total, err := walkLocalDir(localDir, options)
+	if err != nil {
+		return Errorf("failed to walk local directory %s: %w", localDir, err)
+	}
+
+	// stage the tree as the login user, then move it in place with sudo
+	stageDir := path.Join(p.sshTempDir, RandFileName(16))
+	defer p.SudoSSHWithOptions(sshHelperOptions, "rm -rf %s", ShellQuote(stageDir))
+
+	mkdirCommands := []string{Sprintf("mkdir -p %s", ShellQuote(stageDir))}
+	linkCommands := []string{}
+	for _, entry := range entries {
+		switch entry.kind {
+		case sshDirEntryDir:
+			mkdirCommands = append(mkdirCommands, Sprintf("mkdir -p %s", ShellQuote(path.Join(stageDir, entry.relPath))))
+		case sshDirEntrySymlink:
+			linkCommands = append(linkCommands, Sprintf("ln -s %s", ShellArgs(entry.target, path.Join(stageDir, entry.relPath))))
+		}
+	}
+
+	if err := p.runBatched(mkdirCommands, false); err != nil {
+		return err
+	}
+
+	transfer := p.newDirTransfer(options, TransferUpload, localDir, total)
+	for _, entry := range entries {
+		if entry.kind != sshDirEntryFile {
+			continue
+		}
+
+		if err := p.upload(
+			filepath.Join(localDir, filepath.FromSlash(entry.relPath)),
+			path.Join(stageDir, entry.relPath),
+			0,
+			transfer.progress(),
+		); err != nil {
+			return err
+		}
+
+		transfer.add(entry.size)
+	}
+
+	if err := p.runBatched(linkCommands, false); err != nil {
+		return err
+	}
+
+	if err := p.CreateDirectory(remoteDir, user, group, 0755); err != nil {
+		return err
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "chown -R -h %s", ShellArgs(user+":"+group, stageDir)); result.IsFailure() {
+		return result.Error()
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "find %s -type f -exec chmod %o {} +", ShellQuote(stageDir), mode); result.IsFailure() {
+		return result.Error()
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "find %s -type d -exec chmod 755 {} +", ShellQuote(stageDir)); result.IsFailure() {
+		return result.Error()
+	} else if result := p.SudoSSHWithOptions(sshHelperOptions, "cp -a %s", ShellArgs(stageDir+"/.", remoteDir+"/")); result.IsFailure() {
+		return result.Error()
+	} else {
+		transfer.finish()
+		return nil
+	}
+}
+
+func walkRemoteDir(client *SFTPClient, remoteDir string, relDir string, options *SSHDirOptions) ([]sshDirEntry, int64, error) {
+	infos, err := client.ReadDir(path.Join(remoteDir, relDir))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ret := []sshDirEntry{}
+	total := int64(0)
+
+	for _, info := range infos {
+		// a name sent by a malicious server must not leave the directory
+		name := info.Name()
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+			return nil, 0, Errorf("invalid name %q in remote directory %s", name, path.Join(remoteDir, relDir))
+		}
+		rel := path.Join(relDir, name)
+
+		switch {
+		case info.IsDir():
+			if options.skip(sshDirEntryDir, rel) {
+				continue
+			} else if children, size, err := walkRemoteDir(client, remoteDir, rel, options); err != nil {
+				return nil, 0, err
+			} else {
+				ret = append(ret, sshDirEntry{kind: sshDirEntryDir, relPath: rel})
+				ret = append(ret, children...)
+				total += size
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			if options.skip(sshDirEntrySymlink, rel) {
+				continue
+			} else if target, err := client.ReadLink(path.Join(remoteDir, rel)); err != nil {
+				return nil, 0, err
+			} else {
+				ret = append(ret, sshDirEntry{kind: sshDirEntrySymlink, relPath: rel, target: target})
+			}
+		case info.Mode().IsRegular():
+			if options.skip(sshDirEntryFile, rel) {
+				continue
+			}
+			ret = append(ret, sshDirEntry{kind: sshDirEntryFile, relPath: rel, size: info.Size()})
+			total += info.Size()
+		default:
+			Ignore()
+		}
+	}
+
+	return ret, total, nil
+}
+
+// lookupLocalOwner resolves user and group names, -1 keeps the current value
+func lookupLocalOwner(userName string, groupName string) (int, int, error) {
+	uid, gid := -1, -1
+
+	if userName != "" {
+		if u, err := user.Lookup(userName); err != nil {
+			return 0, 0, err
+		} else if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if groupName != "" {
+		if g, err := user.LookupGroup(groupName); err != nil {
+			return 0, 0, err
+		} else if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// DownloadDir downloads the remote directory tree into localDir keeping
+// relative paths. Empty directories and symlinks are recreated, regular
+// files get mode, directories get mode 0755. user and group are applied
+// locally when not empty.
+func (p *SSHClient) DownloadDir(
+	remoteDir string, localDir string,
+	user string, group string, mode os.FileMode,
+	options *SSHDirOptions,
+) error {
+	localDir = filepath.Clean(expandHomePath(localDir))
+
+	if err := p.stubbedProbe("download %s", remoteDir); err != nil {
+		return err
+	}
+
+	uid, gid, err := lookupLocalOwner(user, group)
+	if err != nil {
+		return Errorf("failed to lookup local owner %s:%s: %w", user, group, err)
+	}
+
+	client, err := p.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	entries, total, err := walkRemoteDir(client, remoteDir, "", options)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return Errorf("failed to create local directory %s: %w", localDir, err)
+	}
+
+	transfer := p.newDirTransfer(options, TransferDownload, remoteDir, total)
+	paths, err := downloadDirEntries(localDir, entries, func(entry sshDirEntry, localPath string) error {
+		if err := p.sftpDownloadFile(
+			client, path.Join(remoteDir, entry.relPath), localPath, mode, transfer.progress(),
+		); err != nil {
+			return err
+		}
+		transfer.add(entry.size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if uid >= 0 || gid >= 0 {
+		for _, localPath := range paths {
+			if err := os.Lchown(localPath, uid, gid); err != nil {
+				return Errorf("failed to chown local file %s: %w", localPath, err)
+			}
+		}
+	}
+
+	transfer.finish()
+	return nil
+}
+
+// downloadDirEntries recreates entries of a remote listing below localDir,
+// fetch writes the regular files. Symlinks are created after everything
+// else, so a hostile listing cannot write through a symlink it made. It
+// returns the local paths, localDir first.
+func downloadDirEntries(
+	localDir string, entries []sshDirEntry,
+	fetch func(entry sshDirEntry, localPath string) error,
+) ([]string, error) {
+	paths := []string{localDir}
+	symlinks := []sshDirEntry{}
+
+	for _, entry := range entries {
+		localPath := filepath.Join(localDir, filepath.FromSlash(entry.relPath))
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, Errorf("remote path %s leaves local directory %s", entry.relPath, localDir)
+		}
+		paths = append(paths, localPath)
+
+		switch entry.kind {
+		case sshDirEntryDir:
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				return nil, Errorf("failed to create local directory %s: %w", localPath, err)
+			} else if err := os.Chmod(localPath, 0755); err != nil {
+				return nil, Errorf("failed to chmod local directory %s: %w", localPath, err)
+			}
+		case sshDirEntrySymlink:
+			symlinks = append(symlinks, entry)
+		case sshDirEntryFile:
+			if err := fetch(entry, localPath); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, entry := range symlinks {
+		localPath := filepath.Join(localDir, filepath.FromSlash(entry.relPath))
+		if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+			return nil, Errorf("failed to replace local file %s: %w", localPath, err)
+		} else if err := os.Symlink(entry.target, localPath); err != nil {
+			return nil, Errorf("failed to create local symlink %s: %w", localPath, err)
+		}
+	}
+
+	return paths, nil
+}
+
+// sftpDownloadFile copies a single remote file with an open sftp client
+func (p *SSHClient) sftpDownloadFile(
+	client *SFTPClient,
+	remotePath string, localPath string, mode os.FileMode,
+	progress TransferProgress,
+) error {
+	file, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return Errorf("failed to create local file %s: %w", localPath, err)
+	}
+	defer file.Close()
+
+	if err := p.sftpReceive(client, remotePath, file, progress); err != nil {
+		return err
+	} else if err := file.Chmod(mode); err != nil {
+		return Errorf("failed to chmod local file %s: %w", localPath, err)
+	} else if err := file.Close(); err != nil {
+		return Errorf("failed to write local file %s: %w", localPath, err)
+	} else {
+		return nil
+	}
+}
@@ -0,0 +1,89 @@
+package x
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadDirEntriesHostile(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []sshDirEntry
+	}{
+		{"symlink then directory", func(outside string) []sshDirEntry {
+			return []sshDirEntry{
+				{kind: sshDirEntrySymlink, relPath: "x", target: outside},
+				{kind: sshDirEntryDir, relPath: "x"},
+				{kind: sshDirEntryFile, relPath: "x/passwd"},
+			}
+		}},
+		{"symlink then file below it", func(outside string) []sshDirEntry {
+			return []sshDirEntry{
+				{kind: sshDirEntrySymlink, relPath: "x", target: outside},
+				{kind: sshDirEntryFile, relPath: "x/passwd"},
+			}
+		}},
+		{"nested symlink", func(outside string) []sshDirEntry {
+			return []sshDirEntry{
+				{kind: sshDirEntryDir, relPath: "a"},
+				{kind: sshDirEntrySymlink, relPath: "a/b", target: outside},
+				{kind: sshDirEntryFile, relPath: "a/b/passwd"},
+			}
+		}},
+		{"parent path", func(outside string) []sshDirEntry {
+			return []sshDirEntry{
+				{kind: sshDirEntryFile, relPath: "../passwd"},
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			localDir, outside := filepath.Join(root, "local"), filepath.Join(root, "outside")
+			for _, dir := range []string{localDir, outside} {
+				if err := os.Mkdir(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, _ = downloadDirEntries(localDir, test.entries(outside), func(entry sshDirEntry, localPath string) error {
+				return os.WriteFile(localPath, []byte(entry.relPath), 0644)
+			})
+
+			if names, err := os.ReadDir(outside); err != nil {
+				t.Fatal(err)
+			} else if len(names) > 0 {
+				t.Fatalf("wrote %s outside the local directory", names[0].Name())
+			} else if _, err := os.Stat(filepath.Join(root, "passwd")); err == nil {
+				t.Fatal("wrote passwd outside the local directory")
+			}
+		})
+	}
+}
+
+func TestDownloadDirEntries(t *testing.T) {
+	localDir := t.TempDir()
+	entries := []sshDirEntry{
+		{kind: sshDirEntryDir, relPath: "a"},
+		{kind: sshDirEntrySymlink, relPath: "a/link", target: "file"},
+		{kind: sshDirEntryFile, relPath: "a/file"},
+		{kind: sshDirEntryDir, relPath: "empty"},
+	}
+
+	paths, err := downloadDirEntries(localDir, entries, func(entry sshDirEntry, localPath string) error {
+		return os.WriteFile(localPath, []byte(entry.relPath), 0644)
+	})
+	if err != nil {
+		t.Fatalf("downloadDirEntries: %v", err)
+	} else if len(paths) != len(entries)+1 || paths[0] != localDir {
+		t.Fatalf("unexpected paths %q", paths)
+	}
+
+	if content, err := os.ReadFile(filepath.Join(localDir, "a", "link")); err != nil || string(content) != "a/file" {
+		t.Fatalf("symlink reads %q, %v", content, err)
+	} else if info, err := os.Stat(filepath.Join(localDir, "empty")); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package x
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// SSHDryRunMode selects whether the SSHClient runs or records its changes
+type SSHDryRunMode string
+
+const (
+	// SSHDryRunOff runs everything, the default
+	SSHDryRunOff SSHDryRunMode = ""
+	// SSHDryRunStubProbes records the changes and answers the read-only
+	// probes without running them, as on a server nothing was deployed to
+	// yet: no file or directory but / exists and no service is enabled or
+	// running. Nothing connects to the server.
+	SSHDryRunStubProbes SSHDryRunMode = "stub"
+	// SSHDryRunRunProbes records the changes and runs the read-only probes
+	// on the server, so the plan only has the changes the server needs
+	SSHDryRunRunProbes SSHDryRunMode = "run"
+)
+
+// ErrSSHDryRunStub is returned by probes without a stubbed answer, like
+// downloads and GetLinuxArch, with SSHDryRunStubProbes
+var ErrSSHDryRunStub = errors.New("probe is stubbed in dry-run mode")
+
+// sshHelperOptions are the options of the commands of the helper methods
+var sshHelperOptions = &SSHCommandOptions{helper: true}
+
+// sshProbeOptions marks the read-only commands of the helper methods
+var sshProbeOptions = &SSHCommandOptions{ReadOnly: true, helper: true}
+
+// SSHPlanStepKind is the kind of change of an SSHPlanStep
+type SSHPlanStepKind string
+
+const (
+	SSHPlanCommand SSHPlanStepKind = "command"
+	SSHPlanUpload  SSHPlanStepKind = "upload"
+)
+
+// SSHPlanStep is a change recorded in dry-run mode
+type SSHPlanStep struct {
+	Kind SSHPlanStepKind `json:"kind"`
+	Host string          `json:"host"`
+	User string          `json:"user"`
+
+	// Command is the command as it would be sent, with the sudo and sh -c
+	// wrappers. Input is set when it would read input.
+	Command string `json:"command,omitempty"`
+	Sudo    bool   `json:"sudo,omitempty"`
+	Input   bool   `json:"input,omitempty"`
+
+	// Source is the local file or the name of the uploaded data, Path the
+	// remote file it would be written to from Offset on
+	Source string `json:"source,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+func (p *SSHPlanStep) String() string {
+	if p.Kind == SSHPlanUpload {
+		return Sprintf(
+			"%s@%s: upload %s (%d bytes) to %s%s", p.User, p.Host, p.Source, p.Size, p.Path,
+			Ternary(p.Offset > 0, Sprintf(" from byte %d", p.Offset), ""),
+		)
+	}
+	return Sprintf("%s@%s: %s%s", p.User, p.Host, p.Command, Ternary(p.Input, " (with input)", ""))
+}
+
+// SSHPlan is the list of changes recorded by an SSHClient in dry-run mode
+type SSHPlan struct {
+	steps []SSHPlanStep
+	mu    *sync.Mutex
+}
+
+func newSSHPlan() *SSHPlan {
+	return &SSHPlan{steps: []SSHPlanStep{}, mu: &sync.Mutex{}}
+}
+
+func (p *SSHPlan) add(step SSHPlanStep) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = append(p.steps, step)
+}
+
+// Steps returns the recorded changes in the order they were made
+func (p *SSHPlan) Steps() []SSHPlanStep {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]SSHPlanStep, len(p.steps))
+	copy(ret, p.steps)
+	return ret
+}
+
+// Reset forgets the recorded changes
+func (p *SSHPlan) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = []SSHPlanStep{}
+}
+
+// String returns the plan as numbered lines, one per change
+func (p *SSHPlan) String() string {
+	sb := strings.Builder{}
+	for i, step := range p.Steps() {
+		sb.WriteString(Sprintf("%d. %s\n", i+1, step.String()))
+	}
+	return sb.String()
+}
+
+// MarshalJSON encodes the plan as the list of its steps
+func (p *SSHPlan) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Steps())
+}
+
+// JSON returns the plan as indented JSON for review
+func (p *SSHPlan) JSON() (string, error) {
+	ret, err := json.MarshalIndent(p.Steps(), "", "  ")
+	if err != nil {
+		return "", Errorf("failed to encode plan: %w", err)
+	}
+	return string(ret), nil
+}
+
+// SetDryRun sets the dry-run mode. In dry-run mode commands and uploads
+// are recorded into the plan of the SSHClient instead of running, commands
+// marked ReadOnly and the probes of the helper methods are stubbed or run
+// as mode says. Downloads are probes, SFTP clients and forwards are not
+// affected.
+func (p *SSHClient) SetDryRun(mode SSHDryRunMode) *SSHClient {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	p.dryRun = mode
+	return p
+}
+
+// Plan returns the changes recorded in dry-run mode
+func (p *SSHClient) Plan() *SSHPlan {
+	return p.plan
+}
+
+func (p *SSHClient) dryRunMode() SSHDryRunMode {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	return p.dryRun
+}
+
+// stubProbes reports whether probes are answered without running them
+func (p *SSHClient) stubProbes() bool {
+	return p.dryRunMode() == SSHDryRunStubProbes
+}
+
+// stubbedProbe returns ErrSSHDryRunStub for the probe when probes are
+// stubbed, nil otherwise
+func (p *SSHClient) stubbedProbe(format string, args ...any) error {
+	if p.stubProbes() {
+		return Errorf("%s: %w", Sprintf(format, args...), ErrSSHDryRunStub)
+	}
+	return nil
+}
+
+// dryRunCommand records command unless it is read-only and returns a
+// successful result without output
+func (p *SSHClient) dryRunCommand(command string, sudo bool, readOnly bool, input bool) *SSHResult {
+	if !readOnly {
+		p.plan.add(SSHPlanStep{
+			Kind:    SSHPlanCommand,
+			Host:    p.config.Host,
+			User:    p.config.User,
+			Command: command,
+			Sudo:    sudo,
+			Input:   input,
+		})
+
+		p.printf("yellow", "dry-run ")
+		p.printf("purple", "%s@%s: ", p.config.User, p.config.Host)
+		p.printf("blue", "%s\n", command)
+	}
+
+	ret := p.newSSHResult(command, nil)
+	ret.exitCode = 0
+	return ret
+}
+
+// dryRunUpload records the upload of size bytes of name to remotePath
+func (p *SSHClient) dryRunUpload(name string, remotePath string, size int64, offset int64) {
+	p.plan.add(SSHPlanStep{
+		Kind:   SSHPlanUpload,
+		Host:   p.config.Host,
+		User:   p.config.User,
+		Source: name,
+		Path:   remotePath,
+		Size:   size,
+		Offset: offset,
+	})
+
+	p.printf("yellow", "dry-run ")
+	p.printf("blue", "upload %s ", name)
+	p.printf("purple", "%s@%s:", p.config.User, p.config.Host)
+	p.printf("blue", "%s\n", remotePath)
+}
@@ -0,0 +1,68 @@
+package x_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ootiny/x"
+	"github.com/ootiny/x/sshtest"
+)
+
+func TestDryRunStubProbes(t *testing.T) {
+	// nothing connects with stubbed probes, so the client is never opened
+	client := x.NewSSHClient(x.SSHConfig{User: "deploy", Host: "192.0.2.1", Password: "secret"}).
+		SetDryRun(x.SSHDryRunStubProbes)
+
+	if err := client.CreateDirectory("/opt/app", "app", "app", 0755); err != nil {
+		t.Fatalf("CreateDirectory: %v", err)
+	} else if err := client.SCPBytes([]byte("port = 80\n"), "/opt/app/app.conf", "app", "app", 0640); err != nil {
+		t.Fatalf("SCPBytes: %v", err)
+	} else if _, err := client.GetLinuxArch(); !errors.Is(err, x.ErrSSHDryRunStub) {
+		t.Fatalf("GetLinuxArch: %v", err)
+	}
+
+	plan := client.Plan().String()
+	for _, want := range []string{"mkdir -p /opt/app", "upload ", "/opt/app/app.conf", "chmod 640"} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("plan misses %q:\n%s", want, plan)
+		}
+	}
+	if strings.Contains(plan, "test -d") {
+		t.Errorf("plan has probes:\n%s", plan)
+	}
+
+	client.Plan().Reset()
+	if steps := client.Plan().Steps(); len(steps) != 0 {
+		t.Fatalf("Reset left %d steps", len(steps))
+	}
+
+	// only the options of a command mark it read-only
+	client.SetCommandOptions(&x.SSHCommandOptions{ReadOnly: true})
+	client.SSH("systemctl restart app")
+	client.SSHWithOptions(&x.SSHCommandOptions{ReadOnly: true}, "systemctl status app")
+	if steps := client.Plan().Steps(); len(steps) != 1 || steps[0].Command != "systemctl restart app" {
+		t.Fatalf("unexpected plan:\n%s", client.Plan())
+	}
+}
+
+func TestDryRunRunProbes(t *testing.T) {
+	server := sshtest.NewServer().
+		SetPassword("root", "secret").
+		HandleCommand(`^test -d /opt `, "yes\n", "", 0).
+		HandleCommand(`^test -d `, "no\n", "", 0)
+	defer server.Close()
+	client := openTestClient(t, server.SSHConfig("root")).SetDryRun(x.SSHDryRunRunProbes)
+
+	if err := client.CreateDirectory("/opt/app", "app", "app", 0755); err != nil {
+		t.Fatalf("CreateDirectory: %v", err)
+	}
+
+	server.AssertCommands(t, `^test -d /opt/app `, `^test -d /opt `)
+	server.AssertNoCommand(t, `mkdir|chown|chmod`)
+
+	steps := client.Plan().Steps()
+	if len(steps) != 3 || steps[0].Kind != x.SSHPlanCommand || steps[0].Command != "mkdir -p /opt/app" {
+		t.Fatalf("unexpected plan:\n%s", client.Plan())
+	}
+}
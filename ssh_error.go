@@ -0,0 +1,118 @@
+package x
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHConnectionError is the error of a command that could not run or lost
+// its connection before it finished, the command may or may not have run
+type SSHConnectionError struct {
+	Host string
+	Err  error
+}
+
+func (p *SSHConnectionError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *SSHConnectionError) Unwrap() error {
+	return p.Err
+}
+
+// SSHExitError is the error of a command that exited with a non-zero code
+// or was killed by a signal. It unwraps to the *ssh.ExitError.
+type SSHExitError struct {
+	Host     string
+	Command  string
+	ExitCode int
+	Signal   string // empty unless the command was killed by a signal
+	Err      *ssh.ExitError
+}
+
+func (p *SSHExitError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *SSHExitError) Unwrap() error {
+	return p.Err
+}
+
+// SSHExpectError is the error returned by the expect callback of a command
+// or the error of its expect script
+type SSHExpectError struct {
+	Host    string
+	Command string
+	Err     error
+}
+
+func (p *SSHExpectError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *SSHExpectError) Unwrap() error {
+	return p.Err
+}
+
+// SSHTimeoutError is the error of a command that was stopped because its
+// context was done or the command timeout passed. Err is the error of the
+// context, like context.DeadlineExceeded.
+type SSHTimeoutError struct {
+	Host    string
+	Command string
+	Err     error
+}
+
+func (p *SSHTimeoutError) Error() string {
+	if errors.Is(p.Err, context.Canceled) {
+		return Sprintf("command canceled: %v", p.Err)
+	}
+	return Sprintf("command timed out: %v", p.Err)
+}
+
+func (p *SSHTimeoutError) Unwrap() error {
+	return p.Err
+}
+
+// SSHSudoError is the error of a sudo command whose password was wrong or
+// could not be sent
+type SSHSudoError struct {
+	Host    string
+	Command string
+	Err     error
+}
+
+func (p *SSHSudoError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *SSHSudoError) Unwrap() error {
+	return p.Err
+}
+
+// IsSSHConnectionError reports whether err is or wraps an SSHConnectionError
+func IsSSHConnectionError(err error) bool {
+	return errors.As(err, new(*SSHConnectionError))
+}
+
+// IsSSHExitError reports whether err is or wraps an SSHExitError
+func IsSSHExitError(err error) bool {
+	return errors.As(err, new(*SSHExitError))
+}
+
+// IsSSHExpectError reports whether err is or wraps an SSHExpectError
+func IsSSHExpectError(err error) bool {
+	return errors.As(err, new(*SSHExpectError))
+}
+
+// IsSSHSudoError reports whether err is or wraps an SSHSudoError
+func IsSSHSudoError(err error) bool {
+	return errors.As(err, new(*SSHSudoError))
+}
+
+// IsSSHTimeoutError reports whether err is or wraps an SSHTimeoutError
+func IsSSHTimeoutError(err error) bool {
+	return errors.As(err, new(*SSHTimeoutError))
+}
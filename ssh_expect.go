@@ -0,0 +1,197 @@
+package x
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SSHExpect is an expect script that answers the prompts of a command.
+// One-shot rules match in the order they were added, each one waits for
+// its prompt after the previous one matched. Repeating rules answer their
+// prompt every time it shows up. The output up to the end of a match is
+// consumed, so the same prompt is never answered twice.
+//
+//	expect := x.NewSSHExpect().
+//		Expect("Username:", "admin\n").
+//		Expect("Password:", "secret\n").Timeout(10 * time.Second).
+//		ExpectRegexp(`Continue\? \[y/N\]`, "y\n").Repeat()
+//	client.SSHWithExpect(expect, "./install.sh")
+type SSHExpect struct {
+	rules   []*sshExpectRule
+	timeout time.Duration
+}
+
+type sshExpectRule struct {
+	substring string
+	pattern   *regexp.Regexp
+	answer    string
+	repeat    bool
+	timeout   time.Duration
+}
+
+// NewSSHExpect creates an empty expect script
+func NewSSHExpect() *SSHExpect {
+	return &SSHExpect{rules: []*sshExpectRule{}}
+}
+
+// Expect adds a one-shot rule that answers the output containing substring,
+// an empty answer consumes the output without answering it
+func (p *SSHExpect) Expect(substring string, answer string) *SSHExpect {
+	p.rules = append(p.rules, &sshExpectRule{substring: substring, answer: answer})
+	return p
+}
+
+// ExpectRegexp adds a one-shot rule that answers the output matching
+// pattern, $1 or ${name} in answer are replaced by the groups of the match.
+// It panics when pattern is invalid.
+func (p *SSHExpect) ExpectRegexp(pattern string, answer string) *SSHExpect {
+	p.rules = append(p.rules, &sshExpectRule{pattern: regexp.MustCompile(pattern), answer: answer})
+	return p
+}
+
+// Repeat makes the last rule answer its prompt every time it shows up,
+// repeating rules do not wait for the one-shot rules before them
+func (p *SSHExpect) Repeat() *SSHExpect {
+	p.lastRule("Repeat").repeat = true
+	return p
+}
+
+// Timeout sets how long the last rule waits for its prompt, the command is
+// stopped with an SSHExpectError when it does not show up in time. It has
+// no effect on repeating rules.
+func (p *SSHExpect) Timeout(timeout time.Duration) *SSHExpect {
+	p.lastRule("Timeout").timeout = timeout
+	return p
+}
+
+// SetTimeout sets the timeout of the one-shot rules without their own
+// timeout, 0 waits forever
+func (p *SSHExpect) SetTimeout(timeout time.Duration) *SSHExpect {
+	p.timeout = timeout
+	return p
+}
+
+// SSHWithExpect runs the command with expect answering its prompts
+func (p *SSHClient) SSHWithExpect(expect *SSHExpect, format string, args ...any) *SSHResult {
+	return p.ssh(context.Background(), false, nil, nil, expect, format, args...)
+}
+
+// SudoSSHWithExpect is SudoSSH with expect answering the prompts of the
+// command, the password of sudo is sent as by SudoSSH
+func (p *SSHClient) SudoSSHWithExpect(expect *SSHExpect, format string, args ...any) *SSHResult {
+	return p.ssh(context.Background(), p.config.User != "root", nil, nil, expect, format, args...)
+}
+
+func (p *SSHExpect) lastRule(method string) *sshExpectRule {
+	if len(p.rules) == 0 {
+		panic(Sprintf("SSHExpect.%s called before a rule was added", method))
+	}
+	return p.rules[len(p.rules)-1]
+}
+
+// nextOnce returns the index of the first one-shot rule from start on
+func (p *SSHExpect) nextOnce(start int) int {
+	for start < len(p.rules) && p.rules[start].repeat {
+		start++
+	}
+	return start
+}
+
+// match finds the earliest match in output of the repeating rules and the
+// one-shot rule next. It returns the rule, the end of the match and the
+// answer, the rule is -1 when nothing matched.
+func (p *SSHExpect) match(output string, next int) (int, int, string) {
+	retRule, retStart, retEnd, retAnswer := -1, -1, -1, ""
+
+	for i, rule := range p.rules {
+		if !rule.repeat && i != next {
+			continue
+		}
+
+		start, end, answer := -1, -1, rule.answer
+		if rule.pattern == nil {
+			if start = strings.Index(output, rule.substring); start >= 0 {
+				end = start + len(rule.substring)
+			}
+		} else if loc := rule.pattern.FindStringSubmatchIndex(output); loc != nil {
+			start, end = loc[0], loc[1]
+			answer = string(rule.pattern.ExpandString(nil, rule.answer, output, loc))
+		} else {
+			Ignore()
+		}
+
+		// empty matches would never consume any output
+		if start >= 0 && end > start && (retRule < 0 || start < retStart) {
+			retRule, retStart, retEnd, retAnswer = i, start, end, answer
+		}
+	}
+
+	return retRule, retEnd, retAnswer
+}
+
+// describe returns the prompt rule waits for
+func (p *sshExpectRule) describe() string {
+	if p.pattern != nil {
+		return Sprintf("/%s/", p.pattern.String())
+	}
+	return Sprintf("%q", p.substring)
+}
+
+// run answers the prompts in output until it is closed, which returns
+// io.EOF, or a one-shot rule timed out
+func (p *SSHExpect) run(output *sshOutput, stdin *sshStdin) error {
+	changeCH := output.GetChangeCH()
+	if changeCH == nil {
+		return io.EOF
+	}
+
+	content, consumed := "", 0
+	next, since := p.nextOnce(0), time.Now()
+
+	for {
+		for {
+			rule, end, answer := p.match(content[consumed:], next)
+			if rule < 0 {
+				break
+			}
+
+			consumed += end
+			if !p.rules[rule].repeat {
+				next, since = p.nextOnce(rule+1), time.Now()
+			}
+
+			if answer != "" {
+				if _, err := Fprint(stdin, answer); err != nil && !stdin.isClosed() {
+					return Errorf("failed to answer %s: %w", p.rules[rule].describe(), err)
+				}
+			}
+		}
+
+		var timer *time.Timer
+		var timeoutCH <-chan time.Time
+		timeout := time.Duration(0)
+		if next < len(p.rules) {
+			timeout = Ternary(p.rules[next].timeout > 0, p.rules[next].timeout, p.timeout)
+		}
+		if timeout > 0 {
+			timer = time.NewTimer(time.Until(since.Add(timeout)))
+			timeoutCH = timer.C
+		}
+
+		select {
+		case v, ok := <-changeCH:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				return io.EOF
+			}
+			content = v
+		case <-timeoutCH:
+			return Errorf("timed out after %s waiting for %s", timeout, p.rules[next].describe())
+		}
+	}
+}
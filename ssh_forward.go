@@ -0,0 +1,376 @@
+package x
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHForwardStats are the counters of a port forward
+type SSHForwardStats struct {
+	Active   int64 // connections currently open
+	Total    int64 // connections accepted so far
+	Failed   int64 // connections that could not be forwarded
+	Sent     int64 // bytes from the listening side to the dialed side
+	Received int64 // bytes from the dialed side to the listening side
+}
+
+// SSHForward is a running port forward created by ForwardLocal,
+// ForwardRemote or ForwardDynamic
+type SSHForward struct {
+	listener net.Listener
+	dial     func(conn net.Conn) (net.Conn, error)
+	owner    *SSHClient
+
+	active   atomic.Int64
+	total    atomic.Int64
+	failed   atomic.Int64
+	sent     atomic.Int64
+	received atomic.Int64
+
+	conns  map[net.Conn]struct{}
+	closed bool
+	mu     *sync.Mutex
+}
+
+// Addr returns the listening address, useful when listening on port 0
+func (p *SSHForward) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Stats returns a snapshot of the connection counters
+func (p *SSHForward) Stats() SSHForwardStats {
+	return SSHForwardStats{
+		Active:   p.active.Load(),
+		Total:    p.total.Load(),
+		Failed:   p.failed.Load(),
+		Sent:     p.sent.Load(),
+		Received: p.received.Load(),
+	}
+}
+
+// Close stops listening and closes all forwarded connections
+func (p *SSHForward) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	conns := p.conns
+	p.conns = map[net.Conn]struct{}{}
+	p.mu.Unlock()
+
+	p.owner.removeForward(p)
+
+	err := p.listener.Close()
+	for conn := range conns {
+		_ = conn.Close()
+	}
+	return err
+}
+
+// track registers conn so Close can close it, false if already closed
+func (p *SSHForward) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *SSHForward) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
+
+func (p *SSHForward) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			_ = p.Close()
+			return
+		}
+
+		p.total.Add(1)
+		go p.handle(conn)
+	}
+}
+
+func (p *SSHForward) handle(conn net.Conn) {
+	if !p.track(conn) {
+		_ = conn.Close()
+		return
+	}
+	defer p.untrack(conn)
+	defer conn.Close()
+
+	target, err := p.dial(conn)
+	if err != nil {
+		p.failed.Add(1)
+		return
+	}
+
+	if !p.track(target) {
+		_ = target.Close()
+		return
+	}
+	defer p.untrack(target)
+	defer target.Close()
+
+	p.active.Add(1)
+	defer p.active.Add(-1)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(&forwardCounter{writer: target, count: &p.sent}, conn)
+		closeWrite(target)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(&forwardCounter{writer: conn, count: &p.received}, target)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// forwardCounter counts the bytes written through it
+type forwardCounter struct {
+	writer io.Writer
+	count  *atomic.Int64
+}
+
+func (p *forwardCounter) Write(data []byte) (int, error) {
+	n, err := p.writer.Write(data)
+	p.count.Add(int64(n))
+	return n, err
+}
+
+// closeWrite half-closes conn when it supports it, so the other side sees EOF
+func closeWrite(conn net.Conn) {
+	if v, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = v.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+}
+
+// forwardClient returns the open connection the forwards run on, a dead
+// connection is redialed first
+func (p *SSHClient) forwardClient() (*ssh.Client, error) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	if err := p.getLastError(); err != nil {
+		return nil, err
+	} else if p.runClient == nil {
+		return nil, Errorf("client is not open")
+	} else if err := p.reconnect(); err != nil {
+		return nil, err
+	} else {
+		return p.runClient, nil
+	}
+}
+
+func (p *SSHClient) startForward(listener net.Listener, dial func(conn net.Conn) (net.Conn, error)) *SSHForward {
+	ret := &SSHForward{
+		listener: listener,
+		dial:     dial,
+		owner:    p,
+		conns:    map[net.Conn]struct{}{},
+		mu:       &sync.Mutex{},
+	}
+
+	p.forwardsMu.Lock()
+	p.forwards[ret] = struct{}{}
+	p.forwardsMu.Unlock()
+
+	go ret.serve()
+	return ret
+}
+
+func (p *SSHClient) removeForward(forward *SSHForward) {
+	p.forwardsMu.Lock()
+	defer p.forwardsMu.Unlock()
+	delete(p.forwards, forward)
+}
+
+// closeForwards closes all running forwards of the SSHClient
+func (p *SSHClient) closeForwards() {
+	p.forwardsMu.Lock()
+	forwards := make([]*SSHForward, 0, len(p.forwards))
+	for forward := range p.forwards {
+		forwards = append(forwards, forward)
+	}
+	p.forwardsMu.Unlock()
+
+	for _, forward := range forwards {
+		_ = forward.Close()
+	}
+}
+
+// ForwardLocal listens on localAddr and forwards every connection to
+// remoteAddr as seen from the remote host, like ssh -L
+func (p *SSHClient) ForwardLocal(localAddr string, remoteAddr string) (*SSHForward, error) {
+	if _, err := p.forwardClient(); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, Errorf("failed to listen on %s: %w", localAddr, err)
+	}
+
+	return p.startForward(listener, func(_ net.Conn) (net.Conn, error) {
+		return p.forwardDial(remoteAddr)
+	}), nil
+}
+
+// ForwardRemote listens on remoteAddr on the remote host and forwards every
+// connection to localAddr as seen from the local host, like ssh -R. The
+// remote listener belongs to the connection, the forward stops when the
+// connection dies.
+func (p *SSHClient) ForwardRemote(remoteAddr string, localAddr string) (*SSHForward, error) {
+	client, err := p.forwardClient()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := client.Listen("tcp", remoteAddr)
+	if err != nil {
+		return nil, Errorf("failed to listen on remote %s: %w", remoteAddr, err)
+	}
+
+	return p.startForward(listener, func(_ net.Conn) (net.Conn, error) {
+		return net.Dial("tcp", localAddr)
+	}), nil
+}
+
+// ForwardDynamic runs a SOCKS5 proxy on localAddr that connects to the
+// requested destinations from the remote host, like ssh -D
+func (p *SSHClient) ForwardDynamic(localAddr string) (*SSHForward, error) {
+	if _, err := p.forwardClient(); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, Errorf("failed to listen on %s: %w", localAddr, err)
+	}
+
+	return p.startForward(listener, func(conn net.Conn) (net.Conn, error) {
+		return socks5Connect(conn, p.forwardDial)
+	}), nil
+}
+
+// SOCKS5 constants, see RFC 1928
+const (
+	socks5Version         = 5
+	socks5NoAuth          = 0
+	socks5NoAcceptable    = 0xff
+	socks5CmdConnect      = 1
+	socks5AddrIPv4        = 1
+	socks5AddrDomain      = 3
+	socks5AddrIPv6        = 4
+	socks5Succeeded       = 0
+	socks5GeneralFailure  = 1
+	socks5HostUnreachable = 4
+	socks5CmdUnsupported  = 7
+	socks5AddrUnsupported = 8
+)
+
+// socks5Connect runs the server side of a SOCKS5 CONNECT and dials the
+// destination through the SSH connection
+func socks5Connect(conn net.Conn, dial func(address string) (net.Conn, error)) (net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	} else if header[0] != socks5Version {
+		return nil, Errorf("socks: unsupported version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	hasNoAuth := false
+	for _, method := range methods {
+		hasNoAuth = hasNoAuth || method == socks5NoAuth
+	}
+	if !hasNoAuth {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return nil, Errorf("socks: no acceptable auth method")
+	} else if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	} else if request[0] != socks5Version {
+		return nil, Errorf("socks: unsupported version %d", request[0])
+	} else if request[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5CmdUnsupported)
+		return nil, Errorf("socks: unsupported command %d", request[1])
+	}
+
+	host := ""
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, Ternary(request[3] == socks5AddrIPv4, net.IPv4len, net.IPv6len))
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5AddrUnsupported)
+		return nil, Errorf("socks: unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	target, err := dial(address)
+	if err != nil {
+		if errors.As(err, new(*ssh.OpenChannelError)) {
+			socks5Reply(conn, socks5HostUnreachable)
+		} else {
+			socks5Reply(conn, socks5GeneralFailure)
+		}
+		return nil, Errorf("socks: failed to connect to %s: %w", address, err)
+	}
+
+	socks5Reply(conn, socks5Succeeded)
+	return target, nil
+}
+
+func socks5Reply(conn net.Conn, code byte) {
+	// the bound address is not known for ssh channels, reply 0.0.0.0:0
+	_, _ = conn.Write([]byte{socks5Version, code, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+}
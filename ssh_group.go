@@ -0,0 +1,291 @@
+package x
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// SSHGroupPolicy decides what an SSHGroup does when a host fails
+type SSHGroupPolicy string
+
+const (
+	// SSHGroupContinueOnError runs every host regardless of failures
+	SSHGroupContinueOnError SSHGroupPolicy = "continue-on-error"
+	// SSHGroupFailFast does not start new hosts after the first failure,
+	// hosts that are already running finish
+	SSHGroupFailFast SSHGroupPolicy = "fail-fast"
+	// SSHGroupRolling runs the hosts in batches of the concurrency limit and
+	// stops after a batch with a failure
+	SSHGroupRolling SSHGroupPolicy = "rolling"
+)
+
+// ErrSSHGroupSkipped is the error of hosts that were not run because of the
+// SSHGroupPolicy
+var ErrSSHGroupSkipped = errors.New("skipped after a failure on another host")
+
+// SSHGroup runs the same step on many hosts in parallel
+type SSHGroup struct {
+	clients     []*SSHClient
+	writers     []*prefixWriter
+	concurrency int
+	policy      SSHGroupPolicy
+	mu          *sync.Mutex
+}
+
+// NewSSHGroup creates an SSHClient for every config. The output of every
+// host is written line by line to stdout and stderr prefixed with its host
+// name, the clients do not echo commands and transfer progress is disabled.
+func NewSSHGroup(configs []SSHConfig) *SSHGroup {
+	ret := &SSHGroup{
+		clients:     make([]*SSHClient, 0, len(configs)),
+		writers:     []*prefixWriter{},
+		concurrency: 10,
+		policy:      SSHGroupContinueOnError,
+		mu:          &sync.Mutex{},
+	}
+
+	outMu := &sync.Mutex{}
+	for _, config := range configs {
+		client := NewSSHClient(config)
+		prefix := Sprintf("[%s] ", client.GetHost())
+		stdout := &prefixWriter{writer: os.Stdout, prefix: prefix, mu: outMu}
+		stderr := &prefixWriter{writer: os.Stderr, prefix: prefix, mu: outMu}
+
+		client.SetStdout(stdout).SetStderr(stderr).SetTransferProgress(NopProgress{})
+		client.quiet = true
+		ret.clients = append(ret.clients, client)
+		ret.writers = append(ret.writers, stdout, stderr)
+	}
+
+	return ret
+}
+
+// SetConcurrency sets the number of hosts that run at the same time
+func (p *SSHGroup) SetConcurrency(concurrency int) *SSHGroup {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.concurrency = Max(1, concurrency)
+	return p
+}
+
+// SetPolicy sets what the group does when a host fails
+func (p *SSHGroup) SetPolicy(policy SSHGroupPolicy) *SSHGroup {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policy = policy
+	return p
+}
+
+// SetOutput sets the writers the prefixed output of all hosts goes to
+func (p *SSHGroup) SetOutput(stdout io.Writer, stderr io.Writer) *SSHGroup {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, writer := range p.writers {
+		writer.setWriter(Ternary(i%2 == 0, stdout, stderr))
+	}
+	return p
+}
+
+// Clients returns the clients of the group in the order of the configs
+func (p *SSHGroup) Clients() []*SSHClient {
+	return p.clients
+}
+
+// Run calls fn for every client and returns the results in the order of the
+// configs. Hosts skipped by the policy get a result with ErrSSHGroupSkipped.
+func (p *SSHGroup) Run(fn func(client *SSHClient) *SSHResult) []*SSHResult {
+	p.mu.Lock()
+	concurrency, policy := p.concurrency, p.policy
+	p.mu.Unlock()
+
+	ret := make([]*SSHResult, len(p.clients))
+	failed := &atomic.Bool{}
+	batchSize := Ternary(policy == SSHGroupRolling, concurrency, Max(1, len(p.clients)))
+
+	for start := 0; start < len(p.clients); start += batchSize {
+		if policy == SSHGroupRolling && failed.Load() {
+			break
+		}
+
+		wg := &sync.WaitGroup{}
+		sem := make(chan struct{}, concurrency)
+
+		for i := start; i < Min(start+batchSize, len(p.clients)); i++ {
+			sem <- struct{}{}
+			if policy == SSHGroupFailFast && failed.Load() {
+				<-sem
+				break
+			}
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				result := fn(p.clients[i])
+				if result == nil {
+					result = newGroupResult(p.clients[i], "", nil)
+				}
+				p.writers[2*i].flush()
+				p.writers[2*i+1].flush()
+
+				if result.IsFailure() {
+					failed.Store(true)
+				}
+				ret[i] = result
+			}(i)
+		}
+
+		wg.Wait()
+	}
+
+	for i := range ret {
+		if ret[i] == nil {
+			ret[i] = newGroupResult(p.clients[i], "", ErrSSHGroupSkipped)
+		}
+	}
+
+	return ret
+}
+
+// Open opens all clients and returns their errors joined
+func (p *SSHGroup) Open() error {
+	results := p.Run(func(client *SSHClient) *SSHResult {
+		return newGroupResult(client, "open", client.Open())
+	})
+	return p.JoinErrors(results)
+}
+
+// Close closes all clients and returns their errors joined
+func (p *SSHGroup) Close() error {
+	errs := []error{}
+	for _, client := range p.clients {
+		if err := client.Close(); err != nil {
+			errs = append(errs, Errorf("%s: %w", client.GetHost(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SSH runs the command on all hosts
+func (p *SSHGroup) SSH(format string, args ...any) []*SSHResult {
+	ColorPrintf("purple", "%d hosts: ", len(p.clients))
+	ColorPrintf("blue", "%s\n", Sprintf(format, args...))
+
+	return p.Run(func(client *SSHClient) *SSHResult {
+		return client.SSH(format, args...)
+	})
+}
+
+// SudoSSH runs the command with sudo on all hosts
+func (p *SSHGroup) SudoSSH(format string, args ...any) []*SSHResult {
+	ColorPrintf("purple", "%d hosts: ", len(p.clients))
+	ColorPrintf("blue", "sudo %s\n", Sprintf(format, args...))
+
+	return p.Run(func(client *SSHClient) *SSHResult {
+		return client.SudoSSH(format, args...)
+	})
+}
+
+// SCPFile uploads the local file to all hosts
+func (p *SSHGroup) SCPFile(
+	localPath string, remotePath string,
+	user string, group string, mode os.FileMode,
+) []*SSHResult {
+	return p.Run(func(client *SSHClient) *SSHResult {
+		err := client.SCPFile(localPath, remotePath, user, group, mode)
+		return newGroupResult(client, Sprintf("scp %s %s", localPath, remotePath), err)
+	})
+}
+
+// SCPBytes uploads bytes to all hosts
+func (p *SSHGroup) SCPBytes(
+	bytes []byte, remotePath string,
+	user string, group string, mode os.FileMode,
+) []*SSHResult {
+	return p.Run(func(client *SSHClient) *SSHResult {
+		err := client.SCPBytes(bytes, remotePath, user, group, mode)
+		return newGroupResult(client, Sprintf("scp %d bytes %s", len(bytes), remotePath), err)
+	})
+}
+
+// newGroupResult is the result of a step that runs no single command on
+// client, like Open or an upload. It fails with exit code -1 like commands
+// that did not run.
+func newGroupResult(client *SSHClient, step string, err error) *SSHResult {
+	ret := client.newSSHResult(step, err)
+	ret.exitCode = Ternary(err == nil, 0, -1)
+	return ret
+}
+
+// JoinErrors joins the errors of results returned by the group, each
+// prefixed with the host it comes from. It returns nil when all succeeded.
+func (p *SSHGroup) JoinErrors(results []*SSHResult) error {
+	errs := []error{}
+	for i, result := range results {
+		if result != nil && result.IsFailure() && i < len(p.clients) {
+			errs = append(errs, Errorf("%s: %w", p.clients[i].GetHost(), result.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// prefixWriter writes complete lines prefixed with the host name, so the
+// output of hosts running in parallel does not interleave within a line
+type prefixWriter struct {
+	writer  io.Writer
+	prefix  string
+	partial []byte
+	mu      *sync.Mutex // shared by all writers of a group
+}
+
+func (p *prefixWriter) setWriter(writer io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writer = writer
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.partial = append(p.partial, data...)
+
+	for {
+		index := bytes.IndexByte(p.partial, '\n')
+		if index < 0 {
+			break
+		}
+
+		if err := p.writeLine(p.partial[:index+1]); err != nil {
+			return len(data), err
+		}
+		p.partial = p.partial[index+1:]
+	}
+
+	return len(data), nil
+}
+
+// flush writes the last line when it has no trailing newline
+func (p *prefixWriter) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.partial) > 0 {
+		_ = p.writeLine(append(p.partial, '\n'))
+		p.partial = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	if p.writer == nil {
+		return nil
+	}
+	_, err := p.writer.Write(append([]byte(p.prefix), line...))
+	return err
+}
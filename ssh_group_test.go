@@ -0,0 +1,31 @@
+package x_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/ootiny/x"
+	"github.com/ootiny/x/sshtest"
+)
+
+func TestGroupResults(t *testing.T) {
+	server := handleTestFiles(sshtest.NewServer().SetPassword("root", "secret"))
+	defer server.Close()
+
+	// the second host rejects the password
+	failing := server.SSHConfig("root")
+	failing.Host, failing.Password = "localhost", "wrong"
+	group := x.NewSSHGroup([]x.SSHConfig{server.SSHConfig("root"), failing}).SetOutput(io.Discard, io.Discard)
+	defer group.Close()
+
+	if err := group.Open(); err == nil {
+		t.Fatal("expected Open to fail on the second host")
+	}
+
+	results := group.SCPBytes([]byte("port = 80\n"), "/opt/app/app.conf", "root", "root", 0644)
+	if results[0].IsFailure() || results[0].ExitCode() != 0 || results[0].Host() != server.Host {
+		t.Fatalf("first host: %q, exit code %d, %v", results[0].Host(), results[0].ExitCode(), results[0].Error())
+	} else if results[1].IsSuccess() || results[1].ExitCode() != -1 || results[1].Host() != "localhost" {
+		t.Fatalf("second host: %q, exit code %d, %v", results[1].Host(), results[1].ExitCode(), results[1].Error())
+	}
+}
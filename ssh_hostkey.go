@@ -0,0 +1,209 @@
+package x
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHHostKeyPolicy decides how the server host key is verified when dialing.
+type SSHHostKeyPolicy string
+
+const (
+	// SSHHostKeyAcceptNew trusts unknown hosts on first use and appends their
+	// key to the known_hosts file. Known hosts with a different key are rejected.
+	SSHHostKeyAcceptNew SSHHostKeyPolicy = "accept-new"
+	// SSHHostKeyStrict only accepts hosts whose key is already in known_hosts.
+	SSHHostKeyStrict SSHHostKeyPolicy = "strict"
+	// SSHHostKeyPinned only accepts keys listed in SSHConfig.HostKeyFingerprints.
+	SSHHostKeyPinned SSHHostKeyPolicy = "pinned"
+	// SSHHostKeyInsecure accepts any host key. Only use it when asked for explicitly.
+	SSHHostKeyInsecure SSHHostKeyPolicy = "insecure"
+)
+
+// SSHHostKeyError is returned when the server host key does not pass the
+// configured SSHHostKeyPolicy.
+type SSHHostKeyError struct {
+	Host     string
+	Expected []string // fingerprints we trust for the host, empty if unknown
+	Received string   // fingerprint presented by the server
+}
+
+func (e *SSHHostKeyError) Error() string {
+	if len(e.Expected) == 0 {
+		return Sprintf("unknown host key for %s: received %s", e.Host, e.Received)
+	}
+
+	return Sprintf(
+		"host key mismatch for %s: expected %s, received %s",
+		e.Host, strings.Join(e.Expected, ", "), e.Received,
+	)
+}
+
+// knownHostsMu serializes appends to known_hosts files across clients
+var knownHostsMu = &sync.Mutex{}
+
+// lookupKey is a placeholder key used to list the known keys of a host
+type lookupKey struct{}
+
+func (lookupKey) Type() string                            { return "x-lookup" }
+func (lookupKey) Marshal() []byte                         { return []byte("x-lookup") }
+func (lookupKey) Verify(_ []byte, _ *ssh.Signature) error { return errors.New("x-lookup") }
+
+func expandHomePath(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return path
+}
+
+func (p *SSHClient) hostKeyPolicy() SSHHostKeyPolicy {
+	if p.config.HostKeyPolicy != "" {
+		return p.config.HostKeyPolicy
+	} else if len(p.config.HostKeyFingerprints) > 0 {
+		return SSHHostKeyPinned
+	} else {
+		return SSHHostKeyAcceptNew
+	}
+}
+
+func (p *SSHClient) knownHostsFile() string {
+	if p.config.KnownHostsFile != "" {
+		return expandHomePath(p.config.KnownHostsFile)
+	}
+	return expandHomePath("~/.ssh/known_hosts")
+}
+
+// hostKeyCallback builds the callback and the preferred host key algorithms
+// for the configured policy
+func (p *SSHClient) hostKeyCallback() (ssh.HostKeyCallback, []string, error) {
+	switch policy := p.hostKeyPolicy(); policy {
+	case SSHHostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	case SSHHostKeyPinned:
+		if len(p.config.HostKeyFingerprints) == 0 {
+			return nil, nil, Errorf("host key policy %s requires HostKeyFingerprints", policy)
+		}
+		return p.pinnedHostKeyCallback, nil, nil
+	case SSHHostKeyStrict, SSHHostKeyAcceptNew:
+		file := p.knownHostsFile()
+
+		// a missing known_hosts is created for accept-new, and for strict
+		// it simply means that no host is known yet
+		files := []string{file}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			Ignore()
+		} else if policy == SSHHostKeyStrict {
+			files = []string{}
+		} else if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, nil, Errorf("failed to create known_hosts directory: %w", err)
+		} else if f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+			return nil, nil, Errorf("failed to create known_hosts file: %w", err)
+		} else {
+			_ = f.Close()
+		}
+
+		callback, err := knownhosts.New(files...)
+		if err != nil {
+			return nil, nil, Errorf("failed to load known_hosts %s: %w", file, err)
+		}
+
+		address := net.JoinHostPort(p.config.Host, Sprintf("%d", p.config.Port))
+		algorithms := knownHostKeyAlgorithms(callback, address)
+
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := callback(hostname, remote, key)
+
+			keyErr := (*knownhosts.KeyError)(nil)
+			if err == nil {
+				return nil
+			} else if !errors.As(err, &keyErr) {
+				return err
+			} else if len(keyErr.Want) > 0 || policy == SSHHostKeyStrict {
+				return newSSHHostKeyError(hostname, keyErr.Want, key)
+			} else {
+				return appendKnownHost(file, hostname, key)
+			}
+		}, algorithms, nil
+	default:
+		return nil, nil, Errorf("unknown host key policy: %s", policy)
+	}
+}
+
+func (p *SSHClient) pinnedHostKeyCallback(hostname string, _ net.Addr, key ssh.PublicKey) error {
+	sha256 := ssh.FingerprintSHA256(key)
+	md5 := ssh.FingerprintLegacyMD5(key)
+
+	for _, fingerprint := range p.config.HostKeyFingerprints {
+		fingerprint = strings.TrimSpace(fingerprint)
+		if fingerprint == sha256 || strings.TrimPrefix(fingerprint, "MD5:") == md5 {
+			return nil
+		}
+	}
+
+	return &SSHHostKeyError{
+		Host:     hostname,
+		Expected: p.config.HostKeyFingerprints,
+		Received: sha256,
+	}
+}
+
+func newSSHHostKeyError(hostname string, want []knownhosts.KnownKey, key ssh.PublicKey) error {
+	expected := make([]string, 0, len(want))
+	for _, knownKey := range want {
+		expected = append(expected, ssh.FingerprintSHA256(knownKey.Key))
+	}
+
+	return &SSHHostKeyError{
+		Host:     hostname,
+		Expected: expected,
+		Received: ssh.FingerprintSHA256(key),
+	}
+}
+
+func appendKnownHost(file string, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return Errorf("failed to open known_hosts %s: %w", file, err)
+	}
+	defer f.Close()
+
+	if _, err := Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+		return Errorf("failed to write known_hosts %s: %w", file, err)
+	}
+
+	return nil
+}
+
+// knownHostKeyAlgorithms returns the key algorithms already recorded for the
+// address, so the server does not negotiate a key type we cannot verify
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	keyErr := (*knownhosts.KeyError)(nil)
+	if err := callback(address, &net.TCPAddr{}, lookupKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	ret := []string{}
+	for _, knownKey := range keyErr.Want {
+		switch keyType := knownKey.Key.Type(); keyType {
+		case ssh.KeyAlgoRSA:
+			ret = append(ret, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			ret = append(ret, keyType)
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
@@ -0,0 +1,86 @@
+package x
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newJumpClient builds the client of the last jump host, it reaches the
+// jump hosts before it through its own JumpHosts
+func newJumpClient(hops []SSHConfig) *SSHClient {
+	if len(hops) == 0 {
+		return nil
+	}
+
+	last := hops[len(hops)-1]
+	last.JumpHosts = hops[:len(hops)-1]
+	return NewSSHClient(last)
+}
+
+// tunnel opens a tcp connection to address from the jump host. The
+// connection to the jump host is kept open and shared by all tunnels.
+func (p *SSHClient) tunnel(address string) (net.Conn, error) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	if err := p.getLastError(); err != nil {
+		return nil, err
+	}
+
+	if p.runClient != nil {
+		conn, err := p.runClient.Dial("tcp", address)
+		if err == nil {
+			return conn, nil
+		} else if errors.As(err, new(*ssh.OpenChannelError)) {
+			return nil, Errorf("jump host %s failed to connect to %s: %w", p.config.Host, address, err)
+		} else {
+			// the connection to the jump host is gone, reconnect once
+			_ = p.runClient.Close()
+			p.runClient = nil
+		}
+	}
+
+	client, err := p.dial(p.sshTimeout)
+	if err != nil {
+		return nil, Errorf("failed to dial jump host: %w", err)
+	}
+	p.setRunClient(client)
+
+	conn, err := client.Dial("tcp", address)
+	if err != nil {
+		return nil, Errorf("jump host %s failed to connect to %s: %w", p.config.Host, address, err)
+	}
+	return conn, nil
+}
+
+// dialJump connects to address through the jump hosts
+func (p *SSHClient) dialJump(address string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	conn, err := p.jump.tunnel(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake over a tunnel has no deadline, close it when it takes too long
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			_ = conn.Close()
+		})
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			_ = clientConn.Close()
+		}
+		return nil, Errorf("ssh handshake timed out after %s", timeout)
+	} else if err != nil {
+		_ = conn.Close()
+		return nil, err
+	} else {
+		return ssh.NewClient(clientConn, chans, reqs), nil
+	}
+}
@@ -0,0 +1,147 @@
+package x
+
+import (
+	"context"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHCommandOptions changes how a remote command runs
+type SSHCommandOptions struct {
+	// User runs the command as this user with sudo -u, also for SudoSSH.
+	// The login user changes nothing.
+	User string
+	// Dir is the working directory of the command
+	Dir string
+	// Env are extra environment variables, sent with setenv requests and
+	// exported by the command when the server refuses them or sudo is used
+	Env map[string]string
+	// LoginShell runs the command in a login shell, so the profile of the
+	// user is loaded
+	LoginShell bool
+	// ReadOnly marks a command that changes nothing, dry-run mode stubs it
+	// with an empty successful result or runs it as set by SetDryRun. It is
+	// ignored in SetCommandOptions.
+	ReadOnly bool
+
+	// helper marks the commands of the helper methods, they need the login
+	// user or root and ignore the User of SetCommandOptions
+	helper bool
+}
+
+var sshEnvNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SetCommandOptions sets the options of all commands of the SSHClient,
+// including the commands run by its helper methods, which ignore User.
+// nil clears them.
+func (p *SSHClient) SetCommandOptions(options *SSHCommandOptions) *SSHClient {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	p.cmdOptions = options
+	return p
+}
+
+// SSHWithOptions is SSH with options that override the options of the
+// SSHClient for this command
+func (p *SSHClient) SSHWithOptions(options *SSHCommandOptions, format string, args ...any) *SSHResult {
+	return p.ssh(context.Background(), false, options, nil, nil, format, args...)
+}
+
+// SudoSSHWithOptions is SudoSSH with options that override the options of
+// the SSHClient for this command
+func (p *SSHClient) SudoSSHWithOptions(options *SSHCommandOptions, format string, args ...any) *SSHResult {
+	return p.ssh(context.Background(), p.config.User != "root", options, nil, nil, format, args...)
+}
+
+// commandOptions merges the options of a command into the options of the
+// SSHClient, the fields of options win. ReadOnly only comes from options,
+// a client marked read-only would keep every change out of the plan.
+func (p *SSHClient) commandOptions(options *SSHCommandOptions) *SSHCommandOptions {
+	ret := &SSHCommandOptions{Env: map[string]string{}}
+	helper := options != nil && options.helper
+
+	for _, v := range []*SSHCommandOptions{p.cmdOptions, options} {
+		if v == nil {
+			continue
+		}
+
+		// chown and the like of the helpers fail as another user
+		if !helper {
+			ret.User = Ternary(v.User != "", v.User, ret.User)
+		}
+		ret.Dir = Ternary(v.Dir != "", v.Dir, ret.Dir)
+		ret.LoginShell = ret.LoginShell || v.LoginShell
+		maps.Copy(ret.Env, v.Env)
+	}
+
+	ret.ReadOnly = options != nil && options.ReadOnly
+	return ret
+}
+
+// buildCommand wraps command so it runs as described by options. Env is
+// exported by the command when exportEnv is set or the command runs with
+// sudo, which resets the environment. With sudo and signalReady the command
+// prints sshInputReady to stderr once sudo let it run. It returns whether
+// sudo is used.
+func (p *SSHClient) buildCommand(
+	command string, sudo bool, options *SSHCommandOptions, exportEnv bool, signalReady bool,
+) (string, bool, error) {
+	for name := range options.Env {
+		if !sshEnvNameRegexp.MatchString(name) {
+			return "", false, Errorf("invalid environment variable name %q", name)
+		}
+	}
+
+	// running as the login user needs no sudo -u, SudoSSH still runs
+	// as root then
+	runAs := Ternary(options.User != p.config.User, options.User, "")
+	sudo = sudo || runAs != ""
+
+	script := command
+	if len(options.Env) > 0 && (exportEnv || sudo) {
+		exports := []string{}
+		for _, name := range slices.Sorted(maps.Keys(options.Env)) {
+			exports = append(exports, name+"="+ShellQuote(options.Env[name]))
+		}
+		script = Sprintf("export %s; %s", strings.Join(exports, " "), script)
+	}
+
+	// nothing of the script runs when the cd fails
+	if options.Dir != "" {
+		script = Sprintf("cd %s || exit 1; %s", ShellQuote(options.Dir), script)
+	}
+
+	if sudo && signalReady {
+		script = Sprintf("printf %s >&2; %s", sshInputReady, script)
+	}
+
+	shell := Ternary(options.LoginShell, "sh -lc", "sh -c")
+
+	if runAs != "" {
+		return p.sudoCommand(Sprintf("-u %s -- %s %s", ShellQuote(runAs), shell, ShellQuote(script))), true, nil
+	} else if sudo && (script != command || options.LoginShell) {
+		return p.sudoCommand(Sprintf("%s %s", shell, ShellQuote(script))), true, nil
+	} else if sudo {
+		return p.sudoCommand(command), true, nil
+	} else if options.LoginShell {
+		return Sprintf("%s %s", shell, ShellQuote(script)), false, nil
+	} else {
+		return script, false, nil
+	}
+}
+
+// setenv sends the environment variables of options with setenv requests,
+// false when the server refused one of them
+func setenv(session *ssh.Session, options *SSHCommandOptions) bool {
+	for _, name := range slices.Sorted(maps.Keys(options.Env)) {
+		if err := session.Setenv(name, options.Env[name]); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package x_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/ootiny/x"
+)
+
+func TestCommandOptionsUser(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		run  func(client *x.SSHClient)
+		want string
+		sudo bool
+	}{
+		{"login user", "deploy", func(client *x.SSHClient) {
+			client.SSH("uptime")
+		}, `^uptime$`, false},
+		{"login user keeps sudo", "deploy", func(client *x.SSHClient) {
+			client.SudoSSH("systemctl restart app")
+		}, `^sudo -S -p '\S+' systemctl restart app$`, true},
+		{"other user", "app", func(client *x.SSHClient) {
+			client.SSH("uptime")
+		}, `^sudo -S -p '\S+' -u app -- sh -c '?uptime'?$`, true},
+		{"other user with sudo", "app", func(client *x.SSHClient) {
+			client.SudoSSH("systemctl restart app")
+		}, `^sudo -S -p '\S+' -u app -- sh -c 'systemctl restart app'$`, true},
+		{"helpers ignore the user", "app", func(client *x.SSHClient) {
+			_ = client.CreateDirectory("/opt/app", "app", "app", 0755)
+		}, `^sudo -S -p '\S+' mkdir -p /opt$`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := x.NewSSHClient(x.SSHConfig{User: "deploy", Host: "192.0.2.1", Password: "secret"}).
+				SetDryRun(x.SSHDryRunStubProbes).
+				SetCommandOptions(&x.SSHCommandOptions{User: test.user})
+			test.run(client)
+
+			if steps := client.Plan().Steps(); len(steps) == 0 {
+				t.Fatal("nothing was planned")
+			} else if !regexp.MustCompile(test.want).MatchString(steps[0].Command) || steps[0].Sudo != test.sudo {
+				t.Fatalf("planned %q, sudo %v, want %s", steps[0].Command, steps[0].Sudo, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package x
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// sshResizeInterval is how often the local terminal size is checked for
+// changes, polling also works where there is no SIGWINCH
+const sshResizeInterval = 250 * time.Millisecond
+
+// Shell opens an interactive login shell on a pty with the local terminal,
+// which is put in raw mode until the shell exits
+func (p *SSHClient) Shell() error {
+	return p.localPTY("")
+}
+
+// RunPTY runs the command on a pty with the local terminal, for commands
+// like top that need a terminal. The local terminal is put in raw mode
+// until the command exits.
+func (p *SSHClient) RunPTY(format string, args ...any) error {
+	return p.localPTY(Sprintf(format, args...))
+}
+
+// ShellWithIO is Shell on a pty of the given size that reads its input
+// from rw and writes its output to rw. Reading rw stops with the session
+// when it supports read deadlines like net.Conn, otherwise one more read
+// of rw is made and its data is dropped.
+func (p *SSHClient) ShellWithIO(rw io.ReadWriter, width int, height int) error {
+	return p.runPTY(rw, rw, width, height, nil, "")
+}
+
+// RunPTYWithIO is RunPTY on a pty of the given size that reads its input
+// from rw and writes its output to rw, rw is read like by ShellWithIO
+func (p *SSHClient) RunPTYWithIO(rw io.ReadWriter, width int, height int, format string, args ...any) error {
+	return p.runPTY(rw, rw, width, height, nil, Sprintf(format, args...))
+}
+
+// localPTY runs command, or the login shell when it is empty, with the
+// local terminal
+func (p *SSHClient) localPTY(command string) error {
+	inFd, outFd := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(inFd) || !term.IsTerminal(outFd) {
+		return p.runPTY(os.Stdin, os.Stdout, 80, 24, nil, command)
+	}
+
+	width, height, err := term.GetSize(outFd)
+	if err != nil {
+		return Errorf("failed to get terminal size: %w", err)
+	}
+
+	state, err := term.MakeRaw(inFd)
+	if err != nil {
+		return Errorf("failed to put terminal in raw mode: %w", err)
+	}
+	defer func() {
+		_ = term.Restore(inFd, state)
+	}()
+
+	// os.Stdin has no read deadlines and would swallow the first keystroke
+	// after the session, the terminal opened again has them. Without
+	// /dev/tty, like on Windows, os.Stdin is read.
+	var stdin io.Reader = os.Stdin
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		stdin = tty
+	}
+
+	return p.runPTY(stdin, os.Stdout, width, height, func() (int, int, error) {
+		return term.GetSize(outFd)
+	}, command)
+}
+
+// runPTY runs command, or the login shell when it is empty, on a pty.
+// When size is not nil it is polled and changes are sent to the server.
+func (p *SSHClient) runPTY(
+	stdin io.Reader, stdout io.Writer,
+	width int, height int, size func() (int, int, error),
+	command string,
+) error {
+	if p.dryRunMode() != SSHDryRunOff {
+		return Errorf("interactive sessions are not supported in dry-run mode")
+	} else if err := p.getLastError(); err != nil {
+		return err
+	}
+
+	// an empty command would open the login shell instead of failing
+	if command != "" {
+		p.runMu.Lock()
+		built, _, err := p.buildCommand(command, false, p.commandOptions(nil), true, false)
+		p.runMu.Unlock()
+		if err != nil {
+			return err
+		}
+		command = built
+	}
+
+	release, err := p.acquireSession(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	session, err := p.openSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	termName := Ternary(os.Getenv("TERM") != "", os.Getenv("TERM"), "xterm-256color")
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(termName, height, width, modes); err != nil {
+		return Errorf("failed to request pty: %w", err)
+	}
+
+	session.Stdout = stdout
+	session.Stderr = stdout
+
+	// session.Stdin would make Wait block until the next read from stdin
+	// returns, copy it in the background instead
+	input, err := session.StdinPipe()
+	if err != nil {
+		return Errorf("error creating stdin pipe: %v", err)
+	}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		_, _ = io.Copy(input, stdin)
+		_ = input.Close()
+	}()
+	defer func() {
+		_ = session.Close()
+		stopInput(stdin, copied)
+	}()
+
+	if command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(command)
+	}
+	if err != nil {
+		return &SSHConnectionError{Host: p.config.Host, Err: err}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if size != nil {
+		go watchWindowSize(session, width, height, size, done)
+	}
+
+	var exitError *ssh.ExitError
+	if err := session.Wait(); err == nil {
+		return nil
+	} else if errors.As(err, &exitError) {
+		return &SSHExitError{
+			Host:     p.config.Host,
+			Command:  command,
+			ExitCode: exitError.ExitStatus(),
+			Signal:   exitError.Signal(),
+			Err:      exitError,
+		}
+	} else {
+		return &SSHConnectionError{Host: p.config.Host, Err: err}
+	}
+}
+
+// stopInput stops the copy of stdin into an ended session when stdin has
+// read deadlines, the deadline is cleared again for the next reader
+func stopInput(stdin io.Reader, copied chan struct{}) {
+	reader, ok := stdin.(interface{ SetReadDeadline(time.Time) error })
+	if !ok || reader.SetReadDeadline(time.Now()) != nil {
+		return
+	}
+
+	<-copied
+	_ = reader.SetReadDeadline(time.Time{})
+}
+
+// watchWindowSize sends a window-change request when size changes
+func watchWindowSize(session *ssh.Session, width int, height int, size func() (int, int, error), done chan struct{}) {
+	ticker := time.NewTicker(sshResizeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if w, h, err := size(); err != nil || (w == width && h == height) {
+			continue
+		} else if err := session.WindowChange(h, w); err != nil {
+			return
+		} else {
+			width, height = w, h
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package x
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunPTYInvalidOptions(t *testing.T) {
+	client := NewSSHClient(SSHConfig{User: "deploy", Host: "192.0.2.1", Password: "secret"})
+	client.SetCommandOptions(&SSHCommandOptions{Env: map[string]string{"BAD-NAME": "x"}})
+
+	err := client.RunPTYWithIO(&bytes.Buffer{}, 80, 24, "top")
+	if err == nil || !strings.Contains(err.Error(), "invalid environment variable") {
+		t.Fatalf("expected an invalid environment error, got %v", err)
+	}
+}
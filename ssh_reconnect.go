@@ -0,0 +1,208 @@
+package x
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshReconnectMaxBackoff caps the wait between two redials
+const sshReconnectMaxBackoff = 30 * time.Second
+
+// SetKeepalive sends a keepalive@openssh.com request every interval, the
+// connection is closed as dead after countMax requests in a row got no
+// reply. An interval of 0 disables keepalives.
+func (p *SSHClient) SetKeepalive(interval time.Duration, countMax int) *SSHClient {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	if p.runClient != nil {
+		panic("client is already open")
+	}
+
+	p.keepaliveInterval = interval
+	p.keepaliveCountMax = Max(1, countMax)
+	return p
+}
+
+// SetReconnectRetry sets how many times a dead connection is redialed
+// before the next command, a negative retry disables reconnecting
+func (p *SSHClient) SetReconnectRetry(retry int) *SSHClient {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	p.reconnectRetry = retry
+	return p
+}
+
+// setRunClient makes client the connection of the SSHClient and watches it
+// until it is closed
+func (p *SSHClient) setRunClient(client *ssh.Client) {
+	done := make(chan struct{})
+	p.runClient = client
+	p.runDone = done
+	p.liveClient.Store(client)
+
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+
+	if p.keepaliveInterval > 0 {
+		go p.keepalive(client, done, p.keepaliveInterval, p.keepaliveCountMax)
+	}
+}
+
+// keepalive closes client when it stops answering keepalive requests
+func (p *SSHClient) keepalive(client *ssh.Client, done chan struct{}, interval time.Duration, countMax int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		replyCH := make(chan error, 1)
+		go func() {
+			// the server answers unknown requests with a failure, any answer
+			// proves the connection is alive
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replyCH <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-replyCH:
+			if err != nil {
+				_ = client.Close()
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			if missed++; missed >= countMax {
+				_ = client.Close()
+				return
+			}
+		}
+	}
+}
+
+// isRunClientDead reports whether the open connection was closed by the
+// server, the network or the keepalive
+func (p *SSHClient) isRunClientDead() bool {
+	if p.runClient == nil {
+		return false
+	}
+
+	select {
+	case <-p.runDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconnect redials a dead connection with backoff, it must be called
+// with runMu locked. runMu is released during the backoff, so Close and
+// other commands do not wait for it. Only unrecoverable errors like host
+// key mismatches are recorded by setError, others fail the current call
+// only.
+func (p *SSHClient) reconnect() error {
+	if !p.isRunClientDead() {
+		return nil
+	}
+
+	if p.reconnectRetry < 0 {
+		return &SSHConnectionError{Host: p.config.Host, Err: Errorf("connection is closed")}
+	}
+
+	var retError error
+	backoff := time.Second
+	for i := range p.reconnectRetry + 1 {
+		if i > 0 {
+			p.runMu.Unlock()
+			time.Sleep(backoff)
+			p.runMu.Lock()
+			backoff = Min(backoff*2, sshReconnectMaxBackoff)
+
+			// the client was closed or redialed by another command meanwhile
+			if p.runClient == nil {
+				return &SSHConnectionError{Host: p.config.Host, Err: Errorf("client is closed")}
+			} else if !p.isRunClientDead() {
+				return nil
+			}
+		}
+
+		if client, err := p.dial(p.sshTimeout); err != nil {
+			retError = err
+			if errors.As(err, new(*SSHHostKeyError)) {
+				p.setError(err)
+				return err
+			}
+		} else {
+			p.setRunClient(client)
+			return nil
+		}
+	}
+
+	return &SSHConnectionError{Host: p.config.Host, Err: Errorf("failed to reconnect: %w", retError)}
+}
+
+// dropRunClient closes client when it is still the connection of the
+// SSHClient and waits until it is seen as dead, runMu must be locked
+func (p *SSHClient) dropRunClient(client *ssh.Client) {
+	if client != nil && p.runClient == client {
+		_ = client.Close()
+		<-p.runDone
+	}
+}
+
+// newSession opens a session on the connection and redials it first when
+// it is dead, it must be called with runMu locked
+func (p *SSHClient) newSession() (*ssh.Session, error) {
+	if err := p.reconnect(); err != nil {
+		return nil, err
+	}
+
+	session, err := p.runClient.NewSession()
+	if err == nil || errors.As(err, new(*ssh.OpenChannelError)) {
+		return session, err
+	}
+
+	// the connection died without being noticed yet
+	p.dropRunClient(p.runClient)
+
+	if err := p.reconnect(); err != nil {
+		return nil, err
+	}
+	return p.runClient.NewSession()
+}
+
+// forwardDial dials address from the remote host for the local and dynamic
+// forwards. It does not wait for runMu unless the connection is dead.
+func (p *SSHClient) forwardDial(address string) (net.Conn, error) {
+	if client := p.liveClient.Load(); client != nil {
+		conn, err := client.Dial("tcp", address)
+		if err == nil || errors.As(err, new(*ssh.OpenChannelError)) {
+			return conn, err
+		}
+
+		// the connection died without being noticed yet
+		p.runMu.Lock()
+		p.dropRunClient(client)
+		p.runMu.Unlock()
+	}
+
+	client, err := p.forwardClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial("tcp", address)
+}
@@ -0,0 +1,53 @@
+package x_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ootiny/x"
+	"github.com/ootiny/x/sshtest"
+)
+
+func TestOpenAfterFailure(t *testing.T) {
+	server := sshtest.NewServer().HandleCommand(`uptime`, "up\n", "", 0)
+	defer server.Close()
+
+	config := server.SSHConfig("root")
+	config.Password = "secret"
+	client := x.NewSSHClient(config)
+	defer client.Close()
+	if err := client.Open(); err == nil {
+		t.Fatal("expected Open to fail before the server knows the password")
+	}
+
+	// the failed dial is not kept as the error of the client
+	server.SetPassword("root", "secret")
+	if err := client.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	} else if result := client.SSH("uptime"); !result.IsSuccess() {
+		t.Fatalf("SSH: %v", result.Error())
+	}
+}
+
+func TestCloseDuringReconnect(t *testing.T) {
+	server := sshtest.NewServer().SetPassword("root", "secret")
+	client := openTestClient(t, server.SSHConfig("root"))
+	server.Close()
+
+	resultCH := make(chan *x.SSHResult, 1)
+	go func() {
+		resultCH <- client.SSH("uptime")
+	}()
+
+	// the command waits in the backoff after the first failed redial
+	time.Sleep(300 * time.Millisecond)
+	start := time.Now()
+	_ = client.Close()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Close waited %s for the reconnect", elapsed)
+	}
+
+	if result := <-resultCH; result.IsSuccess() {
+		t.Fatal("expected the command to fail")
+	}
+}
@@ -0,0 +1,82 @@
+package x
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshMaxSessions is the default limit of sessions open at the same time on
+// one connection, the default MaxSessions of OpenSSH
+const sshMaxSessions = 10
+
+// SetMaxSessions limits how many commands run at the same time on the
+// connection of the SSHClient, further commands wait for a free session.
+// It must not be more than the MaxSessions of the server.
+func (p *SSHClient) SetMaxSessions(maxSessions int) *SSHClient {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	// sessions that are running release the slot of the old limit
+	p.sessionSlots = make(chan struct{}, Max(1, maxSessions))
+	return p
+}
+
+// acquireSession waits until less than the maximum number of sessions are
+// open, the returned function releases the session again
+func (p *SSHClient) acquireSession(ctx context.Context) (func(), error) {
+	p.runMu.Lock()
+	slots := p.sessionSlots
+	p.runMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// openSession opens a session on the connection, runMu is held while the
+// session is opened only. A dead connection is redialed, connection errors
+// are not recorded by setError so the next command can try again.
+func (p *SSHClient) openSession() (*ssh.Session, error) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	if p.runClient == nil {
+		reportErr := &SSHConnectionError{Host: p.config.Host, Err: Errorf("client is not open")}
+		p.setError(reportErr)
+		return nil, reportErr
+	}
+
+	session, err := p.newSession()
+	if err != nil {
+		return nil, &SSHConnectionError{Host: p.config.Host, Err: Errorf("failed to create session: %w", err)}
+	}
+	return session, nil
+}
+
+// transferDial dials the dedicated connection of a transfer, runMu is held
+// while dialing only
+func (p *SSHClient) transferDial() (*ssh.Client, error) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	return p.dial(p.scpTimeout)
+}
+
+// lockedWriter serializes the writes of concurrent sessions to the stdout
+// and stderr of the SSHClient
+type lockedWriter struct {
+	writer io.Writer
+	mu     *sync.Mutex
+}
+
+func (p *lockedWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writer.Write(data)
+}
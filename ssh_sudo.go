@@ -0,0 +1,78 @@
+package x
+
+import (
+	"io"
+	"sync"
+)
+
+// sshSudoPrompt replaces the password prompt of sudo, so it can be found in
+// stderr and removed from the output
+const sshSudoPrompt = "x-sudo-password-prompt:"
+
+// sshInputReady is printed to stderr by sudo commands with input once sudo
+// read the password, the input is streamed after it
+const sshInputReady = "x-ssh-input-ready:"
+
+// sudoPassword returns SudoPassword, falling back to Password
+func (p *SSHClient) sudoPassword() string {
+	return Ternary(p.config.SudoPassword != "", p.config.SudoPassword, p.config.Password)
+}
+
+// sudoCommand prefixes command with sudo. With a password sudo prompts with
+// sshSudoPrompt, with an expect callback it prompts as usual for the
+// callback to answer, otherwise it fails instead of waiting for a password.
+func (p *SSHClient) sudoCommand(command string) string {
+	if p.sudoPassword() != "" {
+		return Sprintf("sudo -S -p '%s' %s", sshSudoPrompt, command)
+	} else if p.expect != nil {
+		return Sprintf("sudo -S %s", command)
+	} else {
+		return Sprintf("sudo -n %s", command)
+	}
+}
+
+// sudoPrompter answers the password prompt of sudo. sudo asks again after
+// a wrong password, the second prompt stops the command with an
+// SSHSudoError.
+type sudoPrompter struct {
+	stdin    io.Writer
+	password string
+	stop     func()
+	prompts  int
+	err      error
+	mu       *sync.Mutex
+}
+
+func newSudoPrompter(stdin io.Writer, password string, stop func()) *sudoPrompter {
+	return &sudoPrompter{
+		stdin:    stdin,
+		password: password,
+		stop:     stop,
+		mu:       &sync.Mutex{},
+	}
+}
+
+func (p *sudoPrompter) onPrompt() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prompts++
+	if p.prompts == 1 {
+		if _, err := Fprint(p.stdin, p.password+"\n"); err != nil {
+			p.err = Errorf("failed to send sudo password: %w", err)
+			p.stop()
+		}
+	} else if p.err == nil {
+		p.err = Errorf("sudo: incorrect password")
+		p.stop()
+	} else {
+		Ignore()
+	}
+}
+
+// passwordError returns the error of a wrong or not sent password
+func (p *sudoPrompter) passwordError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
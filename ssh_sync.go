@@ -0,0 +1,170 @@
+package x
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SSHSyncResult tells what SyncFile or SyncBytes changed on the remote
+type SSHSyncResult struct {
+	Changed  bool // anything on the remote changed
+	Uploaded bool // the content differed and was uploaded with owner and mode
+	Chmod    bool // only the mode differed and was fixed
+	Chown    bool // only the owner differed and was fixed
+}
+
+// sshRemoteFileState is the state of a remote file as seen by sync
+type sshRemoteFileState struct {
+	exists bool
+	size   int64
+	user   string
+	group  string
+	uid    string
+	gid    string
+	mode   uint64
+}
+
+func (p *SSHClient) remoteFileState(remotePath string) (*sshRemoteFileState, error) {
+	if p.stubProbes() {
+		return &sshRemoteFileState{exists: false}, nil
+	}
+
+	result := p.SudoSSHWithOptions(
+		sshProbeOptions, "if [ -f %s ]; then stat -c '%%s %%U %%G %%u %%g %%a' %s; else echo missing; fi",
+		ShellQuote(remotePath), ShellQuote(remotePath),
+	)
+	if result.IsFailure() {
+		return nil, result.Error()
+	}
+
+	output := strings.TrimSpace(result.Stdout())
+	if output == "missing" {
+		return &sshRemoteFileState{exists: false}, nil
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) != 6 {
+		return nil, Errorf("invalid stat output for %s: %q", remotePath, output)
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, Errorf("invalid stat output for %s: %q", remotePath, output)
+	}
+
+	mode, err := strconv.ParseUint(fields[5], 8, 32)
+	if err != nil {
+		return nil, Errorf("invalid stat output for %s: %q", remotePath, output)
+	}
+
+	return &sshRemoteFileState{
+		exists: true,
+		size:   size,
+		user:   fields[1],
+		group:  fields[2],
+		uid:    fields[3],
+		gid:    fields[4],
+		mode:   mode,
+	}, nil
+}
+
+func (p *SSHClient) remoteSHA256(remotePath string) (string, error) {
+	if err := p.stubbedProbe("sha256 of %s", remotePath); err != nil {
+		return "", err
+	}
+
+	result := p.SudoSSHWithOptions(sshProbeOptions, "sha256sum %s", ShellQuote(remotePath))
+	if result.IsFailure() {
+		return "", result.Error()
+	}
+
+	fields := strings.Fields(result.Stdout())
+	if len(fields) == 0 {
+		return "", Errorf("invalid sha256sum output for %s: %q", remotePath, result.Stdout())
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// sync compares the remote file with the local content and only uploads,
+// chowns or chmods what differs
+func (p *SSHClient) sync(
+	remotePath string, size int64, sum string,
+	user string, group string, mode os.FileMode,
+	upload func() error,
+) (*SSHSyncResult, error) {
+	state, err := p.remoteFileState(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sameContent := false
+	if state.exists && state.size == size {
+		if remoteSum, err := p.remoteSHA256(remotePath); err != nil {
+			return nil, err
+		} else {
+			sameContent = remoteSum == sum
+		}
+	}
+
+	if !sameContent {
+		if err := upload(); err != nil {
+			return nil, err
+		}
+		return &SSHSyncResult{Changed: true, Uploaded: true}, nil
+	}
+
+	ret := &SSHSyncResult{}
+
+	if (user != state.user && user != state.uid) || (group != state.group && group != state.gid) {
+		if result := p.SudoSSHWithOptions(sshHelperOptions, "chown %s", ShellArgs(user+":"+group, remotePath)); result.IsFailure() {
+			return nil, result.Error()
+		}
+		ret.Changed, ret.Chown = true, true
+	}
+
+	if state.mode != uint64(mode)&07777 {
+		if result := p.SudoSSHWithOptions(sshHelperOptions, "chmod %o %s", mode, ShellQuote(remotePath)); result.IsFailure() {
+			return nil, result.Error()
+		}
+		ret.Changed, ret.Chmod = true, true
+	}
+
+	return ret, nil
+}
+
+// SyncFile is SCPFile that compares size, sha256, owner and mode with the
+// remote file first and only uploads, chowns or chmods what differs
+func (p *SSHClient) SyncFile(
+	localPath string, remotePath string,
+	user string, group string, mode os.FileMode,
+) (*SSHSyncResult, error) {
+	stat, err := os.Stat(expandHomePath(localPath))
+	if err != nil {
+		return nil, Errorf("failed to stat local file %s: %v", localPath, err)
+	}
+
+	sum, err := fileSHA256(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.sync(remotePath, stat.Size(), sum, user, group, mode, func() error {
+		return p.SCPFile(localPath, remotePath, user, group, mode)
+	})
+}
+
+// SyncBytes is SCPBytes that compares size, sha256, owner and mode with the
+// remote file first and only uploads, chowns or chmods what differs
+func (p *SSHClient) SyncBytes(
+	bytes []byte, remotePath string,
+	user string, group string, mode os.FileMode,
+) (*SSHSyncResult, error) {
+	sum := sha256.Sum256(bytes)
+
+	return p.sync(remotePath, int64(len(bytes)), hex.EncodeToString(sum[:]), user, group, mode, func() error {
+		return p.SCPBytes(bytes, remotePath, user, group, mode)
+	})
+}
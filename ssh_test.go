@@ -0,0 +1,90 @@
+package x_test
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ootiny/x"
+	"github.com/ootiny/x/sshtest"
+)
+
+// openTestClient opens a client with config, made by server.SSHConfig, it
+// is closed when the test ends
+func openTestClient(t *testing.T, config x.SSHConfig) *x.SSHClient {
+	t.Helper()
+
+	client := x.NewSSHClient(config)
+	if err := client.Open(); err != nil {
+		t.Fatalf("failed to open client: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+// handleTestFiles answers the commands the upload helpers run on the files
+// below the Root of server
+func handleTestFiles(server *sshtest.Server) *sshtest.Server {
+	args := func(session *sshtest.Session) []string {
+		ret, _ := x.ShellSplit(session.Command)
+		return ret
+	}
+
+	return server.
+		HandleFunc(`^test -d \S+ `, func(session *sshtest.Session) int {
+			info, err := os.Stat(server.Path(args(session)[2]))
+			_, _ = io.WriteString(session.Stdout, x.Ternary(err == nil && info.IsDir(), "yes\n", "no\n"))
+			return 0
+		}).
+		HandleFunc(`^mkdir -p \S+$`, func(session *sshtest.Session) int {
+			if err := os.MkdirAll(server.Path(args(session)[2]), 0755); err != nil {
+				_, _ = io.WriteString(session.Stderr, err.Error())
+				return 1
+			}
+			return 0
+		}).
+		HandleFunc(`^mv \S+ \S+$`, func(session *sshtest.Session) int {
+			if err := os.Rename(server.Path(args(session)[1]), server.Path(args(session)[2])); err != nil {
+				_, _ = io.WriteString(session.Stderr, err.Error())
+				return 1
+			}
+			return 0
+		}).
+		HandleCommand(`^(chown|chmod) `, "", "", 0)
+}
+
+func TestIsLinuxServiceEnabled(t *testing.T) {
+	// systemctl is-enabled exits 0 for static and indirect units as well
+	tests := []struct {
+		unit     string
+		stdout   string
+		exitCode int
+		want     bool
+	}{
+		{"app", "enabled\n", 0, true},
+		{"runtime", "enabled-runtime\n", 0, true},
+		{"static", "static\n", 0, false},
+		{"indirect", "indirect\n", 0, false},
+		{"alias", "alias\n", 0, false},
+		{"disabled", "disabled\n", 1, false},
+	}
+
+	server := sshtest.NewServer().SetPassword("root", "secret")
+	defer server.Close()
+	for _, test := range tests {
+		server.HandleCommand(`^systemctl is-enabled '?`+test.unit+`'?$`, test.stdout, "", test.exitCode)
+	}
+	server.HandleCommand(`^systemctl is-enabled '?missing'?$`, "", "Failed to get unit file state\n", 1)
+	client := openTestClient(t, server.SSHConfig("root"))
+
+	for _, test := range tests {
+		if enabled, err := client.IsLinuxServiceEnabled(test.unit); err != nil || enabled != test.want {
+			t.Errorf("%s: %v, %v, want %v", test.unit, enabled, err, test.want)
+		}
+	}
+	if _, err := client.IsLinuxServiceEnabled("missing"); err == nil {
+		t.Error("expected an error for a missing unit")
+	}
+}
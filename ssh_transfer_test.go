@@ -0,0 +1,202 @@
+package x_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ootiny/x"
+	"github.com/ootiny/x/sshtest"
+)
+
+// slowReader returns chunk bytes of data per read, each after delay
+type slowReader struct {
+	data  []byte
+	chunk int
+	delay time.Duration
+}
+
+func (p *slowReader) Read(buf []byte) (int, error) {
+	if len(p.data) == 0 {
+		return 0, io.EOF
+	}
+
+	time.Sleep(p.delay)
+	n := copy(buf[:min(len(buf), p.chunk)], p.data)
+	p.data = p.data[n:]
+	return n, nil
+}
+
+func TestUploadSlowProgress(t *testing.T) {
+	// the upload takes longer than the scp timeout, but never stalls for it
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+
+	for _, mode := range []x.SSHTransferMode{x.SSHTransferSFTP, x.SSHTransferSCP} {
+		t.Run(string(mode), func(t *testing.T) {
+			server := handleTestFiles(sshtest.NewServer().SetPassword("root", "secret"))
+			defer server.Close()
+
+			config := server.SSHConfig("root")
+			config.TransferMode = mode
+			config.SCPTimeoutMS = 200
+			client := openTestClient(t, config)
+
+			start := time.Now()
+			reader := &slowReader{data: data, chunk: 1024, delay: 40 * time.Millisecond}
+			if err := client.UploadReader(reader, int64(len(data)), "/opt/app/data", "root", "root", 0644); err != nil {
+				t.Fatalf("UploadReader: %v", err)
+			} else if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+				t.Fatalf("upload took %s, shorter than the timeout", elapsed)
+			}
+
+			if content, err := os.ReadFile(server.Path("/opt/app/data")); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(content, data) {
+				t.Fatalf("uploaded %d bytes, want %d", len(content), len(data))
+			}
+		})
+	}
+}
+
+func TestUploadStalled(t *testing.T) {
+	server := handleTestFiles(sshtest.NewServer().SetPassword("root", "secret"))
+	defer server.Close()
+
+	config := server.SSHConfig("root")
+	config.TransferMode = x.SSHTransferSFTP
+	config.SCPTimeoutMS = 200
+	client := openTestClient(t, config)
+
+	reader := &slowReader{data: []byte("x"), chunk: 1, delay: 600 * time.Millisecond}
+	if err := client.UploadReader(reader, 1, "/opt/app/data", "root", "root", 0644); err == nil {
+		t.Fatal("expected the stalled upload to time out")
+	} else if !strings.Contains(err.Error(), "no progress") {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+}
+
+func TestResumeSlowProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	offset := 512 * 1024
+	// more than the channel window, so the client waits for the server
+	slow := 1536 * 1024
+
+	args := func(session *sshtest.Session) []string {
+		ret, _ := x.ShellSplit(session.Command)
+		return ret
+	}
+	server := handleTestFiles(sshtest.NewServer().SetPassword("root", "secret"))
+	defer server.Close()
+	server.
+		HandleFunc(`^if \[ -f \S+ \]; then wc -c`, func(session *sshtest.Session) int {
+			// an interrupted upload left the first bytes
+			if err := os.WriteFile(server.Path(args(session)[3]), data[:offset], 0644); err != nil {
+				return 1
+			}
+			_, _ = x.Fprintf(session.Stdout, "%d\n", offset)
+			return 0
+		}).
+		HandleFunc(`^cat >> \S+$`, func(session *sshtest.Session) int {
+			file, err := os.OpenFile(server.Path(args(session)[2]), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return 1
+			}
+			defer file.Close()
+
+			// read slowly but steadily, then fast so the window drains
+			for received := 0; received < slow; received += 32 * 1024 {
+				time.Sleep(10 * time.Millisecond)
+				if _, err := io.CopyN(file, session.Stdin, 32*1024); err != nil {
+					return 1
+				}
+			}
+			if _, err := io.Copy(file, session.Stdin); err != nil {
+				return 1
+			}
+			return 0
+		})
+
+	config := server.SSHConfig("root")
+	config.TransferMode = x.SSHTransferSCP
+	config.SCPTimeoutMS = 300
+	client := openTestClient(t, config)
+
+	localPath := filepath.Join(t.TempDir(), "artifact")
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := client.SCPFileWithOptions(
+		localPath, "/opt/app/artifact", "root", "root", 0644, &x.SSHTransferOptions{Resume: true},
+	); err != nil {
+		t.Fatalf("SCPFileWithOptions: %v", err)
+	} else if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("upload took %s, shorter than the timeout", elapsed)
+	}
+
+	server.AssertCommand(t, `^cat >> /tmp/\S+\.tmp$`)
+	if content, err := os.ReadFile(server.Path("/opt/app/artifact")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(content, data) {
+		t.Fatalf("uploaded %d bytes, want %d", len(content), len(data))
+	}
+}
+
+func TestSFTPReconnect(t *testing.T) {
+	server := sshtest.NewServer().SetPassword("root", "secret")
+	defer server.Close()
+	client := openTestClient(t, server.SSHConfig("root"))
+
+	// like commands, the sftp session redials the dropped connection
+	server.CloseConnections()
+	sftp, err := client.SFTP()
+	if err != nil {
+		t.Fatalf("SFTP: %v", err)
+	}
+	defer sftp.Close()
+
+	if info, err := sftp.Stat("/tmp"); err != nil || !info.IsDir() {
+		t.Fatalf("Stat: %v", err)
+	}
+}
+
+func TestDownloadFileReplaces(t *testing.T) {
+	server := sshtest.NewServer().SetPassword("root", "secret")
+	defer server.Close()
+
+	config := server.SSHConfig("root")
+	config.TransferMode = x.SSHTransferSFTP
+	client := openTestClient(t, config)
+
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "app.conf")
+	if err := os.WriteFile(localPath, []byte("port = 80\n"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(server.Path("/tmp/app.conf"), []byte("port = 8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed download keeps the old file
+	if err := client.DownloadFile("/tmp/missing.conf", localPath); err == nil {
+		t.Fatal("expected the download of a missing file to fail")
+	} else if content, err := os.ReadFile(localPath); err != nil || string(content) != "port = 80\n" {
+		t.Fatalf("local file is %q after the failure, %v", content, err)
+	}
+
+	if err := client.DownloadFile("/tmp/app.conf", localPath); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	} else if content, err := os.ReadFile(localPath); err != nil || string(content) != "port = 8080\n" {
+		t.Fatalf("downloaded %q, %v", content, err)
+	} else if info, err := os.Stat(localPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("mode of the replaced file changed: %v", err)
+	}
+
+	if names, err := os.ReadDir(localDir); err != nil || len(names) != 1 {
+		t.Fatalf("temp files are left: %v, %v", names, err)
+	}
+}
@@ -0,0 +1,135 @@
+package sshtest
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ootiny/x"
+)
+
+// scpSinkTarget returns the target of a "scp -t" command
+func scpSinkTarget(command string) (string, bool) {
+	args, err := x.ShellSplit(command)
+	if err != nil || len(args) < 2 || args[0] != "scp" {
+		return "", false
+	}
+
+	sink, target := false, ""
+	for _, arg := range args[1:] {
+		if arg == "-t" {
+			sink = true
+		} else if strings.HasPrefix(arg, "-") {
+			x.Ignore()
+		} else {
+			target = arg
+		}
+	}
+
+	return target, sink && target != ""
+}
+
+// scpSink receives files with the sink side of the scp protocol, target is
+// the local path of the remote target. It returns the exit code of scp.
+func (p *Server) scpSink(session *Session, target string) int {
+	reader := bufio.NewReader(session.Stdin)
+	ack := func() {
+		_, _ = session.Stdout.Write([]byte{0})
+	}
+	fail := func(format string, args ...any) int {
+		_, _ = x.Fprintf(session.Stdout, "\x02scp: "+format+"\n", args...)
+		return 1
+	}
+
+	dirs := []string{target}
+	ack()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return 0
+		} else if err != nil {
+			return fail("failed to read command: %s", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fail("protocol error: empty command")
+		}
+
+		switch line[0] {
+		case 'T':
+			ack()
+		case 'C', 'D':
+			fields := strings.SplitN(line[1:], " ", 3)
+			if len(fields) != 3 {
+				return fail("protocol error: %s", line)
+			}
+
+			mode, modeErr := strconv.ParseUint(fields[0], 8, 32)
+			size, sizeErr := strconv.ParseInt(fields[1], 10, 64)
+			name := fields[2]
+			if modeErr != nil || sizeErr != nil || size < 0 {
+				return fail("protocol error: %s", line)
+			} else if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+				return fail("invalid name: %s", name)
+			}
+
+			dir := dirs[len(dirs)-1]
+			dest := filepath.Join(dir, name)
+			if info, err := os.Stat(dir); len(dirs) == 1 && (err != nil || !info.IsDir()) {
+				// the target is the path of the file itself
+				dest = dir
+			}
+
+			if line[0] == 'D' {
+				if err := os.Mkdir(dest, os.FileMode(mode).Perm()); err != nil && !os.IsExist(err) {
+					return fail("%s", err)
+				}
+				dirs = append(dirs, dest)
+				ack()
+			} else if err := scpReceive(reader, dest, os.FileMode(mode).Perm(), size, ack); err != nil {
+				return fail("%s", err)
+			} else {
+				x.Ignore()
+			}
+		case 'E':
+			if len(dirs) == 1 {
+				return fail("protocol error: unexpected E")
+			}
+			dirs = dirs[:len(dirs)-1]
+			ack()
+		case '\x01', '\x02':
+			return 1
+		default:
+			return fail("protocol error: %s", line)
+		}
+	}
+}
+
+// scpReceive writes size bytes of reader to dest, the content is followed
+// by a status byte of the source
+func scpReceive(reader *bufio.Reader, dest string, mode os.FileMode, size int64, ack func()) error {
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	ack()
+
+	if _, err := io.CopyN(file, reader, size); err != nil {
+		_ = file.Close()
+		return err
+	} else if err := file.Close(); err != nil {
+		return err
+	} else if status, err := reader.ReadByte(); err != nil {
+		return err
+	} else if status != 0 {
+		return x.Errorf("source failed sending %s", filepath.Base(dest))
+	} else {
+		ack()
+		return nil
+	}
+}
@@ -0,0 +1,520 @@
+// Package sshtest starts an in-process SSH server on a loopback port, so
+// code built on x.SSHClient can be unit-tested without a real sshd.
+//
+//	server := sshtest.NewServer().
+//		SetPassword("deploy", "secret").
+//		HandleCommand(`systemctl is-active app`, "active\n", "", 0)
+//	defer server.Close()
+//
+//	client := x.NewSSHClient(server.SSHConfig("deploy"))
+//	...
+//	server.AssertCommand(t, `systemctl is-active app`)
+package sshtest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ootiny/x"
+	"golang.org/x/crypto/ssh"
+)
+
+// Handler runs a command received by the Server and returns its exit code
+type Handler func(session *Session) int
+
+// Session is a command received by the Server
+type Session struct {
+	User    string
+	Command string            // the command as sent by the client
+	Match   []string          // the match of the handler pattern and its groups
+	Env     map[string]string // variables sent with setenv requests
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+
+	ctx context.Context
+}
+
+// Context is done when the client sent a signal or closed the session
+func (p *Session) Context() context.Context {
+	return p.ctx
+}
+
+type commandHandler struct {
+	pattern *regexp.Regexp
+	handler Handler
+}
+
+// Server is an in-process SSH server. Uploads with "scp -t" and the sftp
+// subsystem read and write files below Root, other commands are answered
+// by the handler of the first matching pattern. Commands nothing handles
+// fail with exit code 127.
+type Server struct {
+	Addr    string // host:port the server listens on
+	Host    string
+	Port    uint16
+	HostKey ssh.Signer
+	Root    string // temp dir the remote paths of scp and sftp are resolved in, with an empty /tmp
+
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	passwords map[string]string
+	keys      map[string][]ssh.PublicKey
+	handlers  []*commandHandler
+	commands  []string
+	conns     map[net.Conn]bool
+	wg        *sync.WaitGroup
+	mu        *sync.Mutex
+}
+
+// NewServer starts a server on a loopback port, it panics when the server
+// can not be started. Close stops it and removes Root.
+func NewServer() *Server {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		x.Panicf("sshtest: failed to generate host key: %s", err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		x.Panicf("sshtest: failed to create host key: %s", err)
+	}
+
+	root, err := os.MkdirTemp("", "sshtest-")
+	if err != nil {
+		x.Panicf("sshtest: failed to create root: %s", err)
+	}
+
+	// uploads are staged in /tmp before they are moved into place
+	if err := os.Mkdir(filepath.Join(root, "tmp"), 0777); err != nil {
+		_ = os.RemoveAll(root)
+		x.Panicf("sshtest: failed to create root: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = os.RemoveAll(root)
+		x.Panicf("sshtest: failed to listen: %s", err)
+	}
+
+	addr := listener.Addr().(*net.TCPAddr)
+	ret := &Server{
+		Addr:      addr.String(),
+		Host:      addr.IP.String(),
+		Port:      uint16(addr.Port),
+		HostKey:   hostKey,
+		Root:      root,
+		listener:  listener,
+		passwords: map[string]string{},
+		keys:      map[string][]ssh.PublicKey{},
+		handlers:  []*commandHandler{},
+		commands:  []string{},
+		conns:     map[net.Conn]bool{},
+		wg:        &sync.WaitGroup{},
+		mu:        &sync.Mutex{},
+	}
+
+	ret.config = &ssh.ServerConfig{
+		PasswordCallback:  ret.checkPassword,
+		PublicKeyCallback: ret.checkKey,
+	}
+	ret.config.AddHostKey(hostKey)
+
+	ret.wg.Add(1)
+	go ret.serve()
+
+	return ret
+}
+
+// Close stops the server, closes its connections and removes Root
+func (p *Server) Close() {
+	_ = p.listener.Close()
+
+	p.mu.Lock()
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	_ = os.RemoveAll(p.Root)
+}
+
+// CloseConnections closes the open connections like a network failure
+// would, the server keeps accepting new ones
+func (p *Server) CloseConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+}
+
+// SetPassword lets user log in with password
+func (p *Server) SetPassword(user string, password string) *Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.passwords[user] = password
+	return p
+}
+
+// AuthorizeKey lets user log in with the private key of key
+func (p *Server) AuthorizeKey(user string, key ssh.PublicKey) *Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.keys[user] = append(p.keys[user], key)
+	return p
+}
+
+// HandleCommand answers the commands matching pattern with stdout, stderr
+// and exitCode. It panics when pattern is invalid.
+func (p *Server) HandleCommand(pattern string, stdout string, stderr string, exitCode int) *Server {
+	return p.HandleFunc(pattern, func(session *Session) int {
+		_, _ = io.WriteString(session.Stdout, stdout)
+		_, _ = io.WriteString(session.Stderr, stderr)
+		return exitCode
+	})
+}
+
+// HandleFunc runs handler for the commands matching pattern. Patterns match
+// anywhere in the command as sent by the client, which includes the sudo
+// and sh -c wrappers of SudoSSH and SSHWithOptions. Handlers are tried in
+// the order they were added. It panics when pattern is invalid.
+func (p *Server) HandleFunc(pattern string, handler Handler) *Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.handlers = append(p.handlers, &commandHandler{pattern: regexp.MustCompile(pattern), handler: handler})
+	return p
+}
+
+// SSHConfig returns the config of a client that logs in to the server as
+// user, with the password set by SetPassword and the host key pinned
+func (p *Server) SSHConfig(user string) x.SSHConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return x.SSHConfig{
+		User:                user,
+		Host:                p.Host,
+		Port:                p.Port,
+		Password:            p.passwords[user],
+		HostKeyFingerprints: []string{ssh.FingerprintSHA256(p.HostKey.PublicKey())},
+	}
+}
+
+// Path returns the local path of remotePath below Root
+func (p *Server) Path(remotePath string) string {
+	return resolvePath(p.Root, remotePath)
+}
+
+// Commands returns the commands executed so far, in the order they arrived
+func (p *Server) Commands() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return slices.Clone(p.commands)
+}
+
+// ResetCommands forgets the commands executed so far
+func (p *Server) ResetCommands() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.commands = []string{}
+}
+
+// AssertCommand fails t when no executed command matches pattern
+func (p *Server) AssertCommand(t testing.TB, pattern string) {
+	t.Helper()
+
+	re := regexp.MustCompile(pattern)
+	commands := p.Commands()
+	if !slices.ContainsFunc(commands, re.MatchString) {
+		t.Errorf("sshtest: no command matches /%s/, executed:\n%s", pattern, formatCommands(commands))
+	}
+}
+
+// AssertNoCommand fails t when an executed command matches pattern
+func (p *Server) AssertNoCommand(t testing.TB, pattern string) {
+	t.Helper()
+
+	re := regexp.MustCompile(pattern)
+	for _, command := range p.Commands() {
+		if re.MatchString(command) {
+			t.Errorf("sshtest: command %q matches /%s/", command, pattern)
+		}
+	}
+}
+
+// AssertCommands fails t unless commands matching patterns were executed in
+// this order, other commands may run between them
+func (p *Server) AssertCommands(t testing.TB, patterns ...string) {
+	t.Helper()
+
+	commands := p.Commands()
+	next := 0
+	for _, pattern := range patterns {
+		re := regexp.MustCompile(pattern)
+		found := slices.IndexFunc(commands[next:], re.MatchString)
+		if found < 0 {
+			t.Errorf(
+				"sshtest: no command matches /%s/ after the previous patterns, executed:\n%s",
+				pattern, formatCommands(commands),
+			)
+			return
+		}
+		next += found + 1
+	}
+}
+
+func formatCommands(commands []string) string {
+	if len(commands) == 0 {
+		return "  (none)"
+	}
+
+	lines := []string{}
+	for _, command := range commands {
+		lines = append(lines, "  "+command)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *Server) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if expected, ok := p.passwords[conn.User()]; ok && expected == string(password) {
+		return nil, nil
+	}
+	return nil, x.Errorf("password rejected for %s", conn.User())
+}
+
+func (p *Server) checkKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	marshaled := key.Marshal()
+	for _, authorized := range p.keys[conn.User()] {
+		if string(authorized.Marshal()) == string(marshaled) {
+			return nil, nil
+		}
+	}
+	return nil, x.Errorf("public key rejected for %s", conn.User())
+}
+
+func (p *Server) serve() {
+	defer p.wg.Done()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		p.conns[conn] = true
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.handleConn(conn)
+
+			p.mu.Lock()
+			delete(p.conns, conn)
+			p.mu.Unlock()
+		}()
+	}
+}
+
+func (p *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, p.config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+
+	go func() {
+		for request := range requests {
+			if request.WantReply {
+				_ = request.Reply(request.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}()
+
+	sessions := &sync.WaitGroup{}
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			p.handleSession(serverConn.User(), channel, channelRequests)
+		}()
+	}
+	sessions.Wait()
+}
+
+func (p *Server) handleSession(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	env := map[string]string{}
+	started := false
+	exitCH := make(chan int, 1)
+
+	for {
+		select {
+		case request, ok := <-requests:
+			if !ok {
+				return
+			}
+
+			switch request.Type {
+			case "env":
+				var payload struct{ Name, Value string }
+				if !started && ssh.Unmarshal(request.Payload, &payload) == nil {
+					env[payload.Name] = payload.Value
+					_ = request.Reply(true, nil)
+				} else {
+					_ = request.Reply(false, nil)
+				}
+			case "pty-req", "window-change":
+				_ = request.Reply(request.Type == "pty-req", nil)
+			case "signal":
+				cancel()
+			case "exec", "subsystem":
+				var payload struct{ Value string }
+				if started || ssh.Unmarshal(request.Payload, &payload) != nil ||
+					(request.Type == "subsystem" && payload.Value != "sftp") {
+					_ = request.Reply(false, nil)
+					continue
+				}
+
+				started = true
+				_ = request.Reply(true, nil)
+
+				session := &Session{
+					User:   user,
+					Env:    env,
+					Stdin:  channel,
+					Stdout: channel,
+					Stderr: channel.Stderr(),
+					ctx:    ctx,
+				}
+				if request.Type == "subsystem" {
+					go func() {
+						exitCH <- serveSFTP(p.Root, channel)
+					}()
+				} else {
+					session.Command = payload.Value
+					go func() {
+						exitCH <- p.runCommand(session)
+					}()
+				}
+			default:
+				if request.WantReply {
+					_ = request.Reply(false, nil)
+				}
+			}
+		case code := <-exitCH:
+			if ctx.Err() != nil {
+				_, _ = channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal     string
+					CoreDumped bool
+					Message    string
+					Language   string
+				}{"TERM", false, "", ""}))
+			} else {
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Code uint32 }{uint32(code)}))
+			}
+			return
+		}
+	}
+}
+
+// runCommand records the command of session and runs its handler
+func (p *Server) runCommand(session *Session) int {
+	p.mu.Lock()
+	p.commands = append(p.commands, session.Command)
+	handlers := slices.Clone(p.handlers)
+	p.mu.Unlock()
+
+	// sudo never asks for a password here, what the script prints before
+	// the command runs right away
+	runPrintf(session)
+
+	if target, ok := scpSinkTarget(session.Command); ok {
+		return p.scpSink(session, p.Path(target))
+	}
+
+	for _, handler := range handlers {
+		if match := handler.pattern.FindStringSubmatch(session.Command); match != nil {
+			session.Match = match
+			return handler.handler(session)
+		}
+	}
+
+	_, _ = x.Fprintf(session.Stderr, "sshtest: no handler for command: %s\n", session.Command)
+	return 127
+}
+
+// runPrintf runs the printf statements a "sh -c" script starts with, like
+// the one the client wraps into sudo, the rest of the script is left to
+// the handlers. Only plain strings are printed, to stdout or with >&2 to
+// stderr.
+func runPrintf(session *Session) {
+	words, err := x.ShellSplit(session.Command)
+	if err != nil {
+		return
+	}
+
+	script := ""
+	for i := 0; i+2 < len(words); i++ {
+		if words[i] == "sh" && (words[i+1] == "-c" || words[i+1] == "-lc") {
+			script = words[i+2]
+			break
+		}
+	}
+
+	for script != "" {
+		statement, rest, _ := strings.Cut(script, ";")
+		args, err := x.ShellSplit(statement)
+		if err != nil || len(args) < 2 || args[0] != "printf" || strings.Contains(args[1], "%") {
+			return
+		} else if len(args) == 3 && args[2] == ">&2" {
+			_, _ = io.WriteString(session.Stderr, args[1])
+		} else if len(args) == 2 {
+			_, _ = io.WriteString(session.Stdout, args[1])
+		} else {
+			return
+		}
+		script = rest
+	}
+}
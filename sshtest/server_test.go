@@ -0,0 +1,291 @@
+package sshtest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ootiny/x"
+	"github.com/ootiny/x/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// openClient opens a client logged in to server as user, it is closed
+// when the test ends
+func openClient(t *testing.T, server *sshtest.Server, user string, mode x.SSHTransferMode) *x.SSHClient {
+	t.Helper()
+
+	config := server.SSHConfig(user)
+	config.TransferMode = mode
+	client := x.NewSSHClient(config)
+	if err := client.Open(); err != nil {
+		t.Fatalf("failed to open client: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+// handleFiles answers the commands the upload helpers run on the files
+// below the Root of server
+func handleFiles(server *sshtest.Server) *sshtest.Server {
+	args := func(session *sshtest.Session) []string {
+		ret, _ := x.ShellSplit(session.Command)
+		return ret
+	}
+
+	return server.
+		HandleFunc(`^test -d \S+ `, func(session *sshtest.Session) int {
+			info, err := os.Stat(server.Path(args(session)[2]))
+			_, _ = io.WriteString(session.Stdout, x.Ternary(err == nil && info.IsDir(), "yes\n", "no\n"))
+			return 0
+		}).
+		HandleFunc(`^mkdir -p \S+$`, func(session *sshtest.Session) int {
+			if err := os.MkdirAll(server.Path(args(session)[2]), 0755); err != nil {
+				_, _ = io.WriteString(session.Stderr, err.Error())
+				return 1
+			}
+			return 0
+		}).
+		HandleFunc(`^mv \S+ \S+$`, func(session *sshtest.Session) int {
+			if err := os.Rename(server.Path(args(session)[1]), server.Path(args(session)[2])); err != nil {
+				_, _ = io.WriteString(session.Stderr, err.Error())
+				return 1
+			}
+			return 0
+		}).
+		HandleCommand(`^(chown|chmod) `, "", "", 0)
+}
+
+func TestSSHExitCode(t *testing.T) {
+	server := sshtest.NewServer().
+		SetPassword("deploy", "secret").
+		HandleCommand(`uname -m`, "x86_64\n", "", 0).
+		HandleCommand(`systemctl is-active app`, "inactive\n", "", 3)
+	defer server.Close()
+	client := openClient(t, server, "deploy", "")
+
+	if result := client.SSH("uname -m"); !result.IsSuccess() || result.Stdout() != "x86_64" {
+		t.Fatalf("SSH: %v, stdout %q", result.Error(), result.Stdout())
+	}
+
+	result := client.SudoSSH("systemctl is-active app")
+	if result.ExitCode() != 3 || !x.IsSSHExitError(result.Error()) {
+		t.Fatalf("SudoSSH: exit code %d, %v", result.ExitCode(), result.Error())
+	}
+	server.AssertCommand(t, `^sudo -S .*systemctl is-active app$`)
+
+	if running, err := client.IsLinuxServiceRunning("app"); err != nil || running {
+		t.Fatalf("IsLinuxServiceRunning: %v, %v", running, err)
+	}
+
+	if result := client.SSH("missing"); result.ExitCode() != 127 {
+		t.Fatalf("unhandled command: exit code %d", result.ExitCode())
+	}
+}
+
+func TestSCPFile(t *testing.T) {
+	for _, mode := range []x.SSHTransferMode{x.SSHTransferSFTP, x.SSHTransferSCP} {
+		t.Run(string(mode), func(t *testing.T) {
+			server := handleFiles(sshtest.NewServer().SetPassword("root", "secret"))
+			defer server.Close()
+			client := openClient(t, server, "root", mode)
+
+			localPath := filepath.Join(t.TempDir(), "app.conf")
+			if err := os.WriteFile(localPath, []byte("port = 80\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := client.SCPFile(localPath, "/etc/app/app.conf", "root", "root", 0644); err != nil {
+				t.Fatalf("SCPFile: %v", err)
+			}
+
+			if content, err := os.ReadFile(server.Path("/etc/app/app.conf")); err != nil {
+				t.Fatal(err)
+			} else if string(content) != "port = 80\n" {
+				t.Fatalf("uploaded %q", content)
+			}
+
+			server.AssertCommands(t, `^mkdir -p /etc/app$`, `^mv /tmp/\S+\.tmp /etc/app/app.conf$`)
+			if mode == x.SSHTransferSCP {
+				server.AssertCommand(t, `^scp -t /tmp$`)
+			} else {
+				server.AssertNoCommand(t, `^scp `)
+			}
+		})
+	}
+}
+
+func TestSSHContextCancel(t *testing.T) {
+	server := sshtest.NewServer().
+		SetPassword("deploy", "secret").
+		HandleFunc(`sleep`, func(session *sshtest.Session) int {
+			<-session.Context().Done()
+			return 0
+		}).
+		HandleCommand(`uname -m`, "x86_64\n", "", 0)
+	defer server.Close()
+	client := openClient(t, server, "deploy", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	result := client.SSHContext(ctx, "sleep 60")
+	if !x.IsSSHTimeoutError(result.Error()) {
+		t.Fatalf("expected a timeout error, got %v", result.Error())
+	} else if time.Since(start) > 5*time.Second {
+		t.Fatalf("cancel took %s", time.Since(start))
+	}
+
+	// the connection is still usable
+	if result := client.SSH("uname -m"); !result.IsSuccess() {
+		t.Fatalf("SSH after cancel: %v", result.Error())
+	}
+}
+
+func TestSSHWithInput(t *testing.T) {
+	echo := func(session *sshtest.Session) int {
+		input, err := io.ReadAll(session.Stdin)
+		if err != nil {
+			return 1
+		}
+		_, _ = io.WriteString(session.Stdout, strings.ToUpper(string(input)))
+		return 0
+	}
+	server := sshtest.NewServer().SetPassword("deploy", "secret").HandleFunc(`tr a-z A-Z`, echo)
+	defer server.Close()
+	client := openClient(t, server, "deploy", "")
+
+	if result := client.SSHWithInput(strings.NewReader("hello"), "tr a-z A-Z"); result.Stdout() != "HELLO" {
+		t.Fatalf("SSHWithInput: %v, stdout %q", result.Error(), result.Stdout())
+	}
+
+	// sudo holds the input back until the command signals it is ready
+	if result := client.SudoSSHWithInput(strings.NewReader("world"), "tr a-z A-Z"); result.Stdout() != "WORLD" {
+		t.Fatalf("SudoSSHWithInput: %v, stdout %q", result.Error(), result.Stdout())
+	}
+	server.AssertCommand(t, `^sudo -S .*printf .*tr a-z A-Z`)
+}
+
+// sftpPacket encodes a packet field by field as the sftp draft defines it,
+// ints are uint32 and strings are length prefixed
+func sftpPacket(fields ...any) []byte {
+	payload := []byte{}
+	for _, field := range fields {
+		switch v := field.(type) {
+		case byte:
+			payload = append(payload, v)
+		case int:
+			payload = binary.BigEndian.AppendUint32(payload, uint32(v))
+		case uint64:
+			payload = binary.BigEndian.AppendUint64(payload, v)
+		case string:
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(v)))
+			payload = append(payload, v...)
+		default:
+			x.Panicf("sftpPacket: unsupported field %T", field)
+		}
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+}
+
+func TestSFTPPackets(t *testing.T) {
+	server := sshtest.NewServer().SetPassword("root", "secret")
+	defer server.Close()
+
+	conn, err := ssh.Dial("tcp", server.Addr, &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(server.HostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// exchange sends request and returns the type and the payload of the
+	// response, which must answer the request id
+	exchange := func(request []byte) (byte, []byte) {
+		t.Helper()
+
+		if _, err := stdin.Write(request); err != nil {
+			t.Fatal(err)
+		}
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(stdout, header); err != nil {
+			t.Fatal(err)
+		}
+		response := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(stdout, response); err != nil {
+			t.Fatal(err)
+		} else if response[0] != 2 && !bytes.Equal(response[1:5], request[5:9]) {
+			t.Fatalf("response %x answers another request than %x", response, request)
+		}
+		return response[0], response[1:]
+	}
+	status := func(request []byte) uint32 {
+		t.Helper()
+
+		if typ, payload := exchange(request); typ != 101 {
+			t.Fatalf("expected a status, got packet %d", typ)
+		} else {
+			return binary.BigEndian.Uint32(payload[4:])
+		}
+		return 0
+	}
+
+	if typ, payload := exchange(sftpPacket(byte(1), 3)); typ != 2 || binary.BigEndian.Uint32(payload) != 3 {
+		t.Fatalf("expected version 3, got packet %d %x", typ, payload)
+	}
+
+	// OPEN with WRITE|CREAT|TRUNC and permissions
+	typ, payload := exchange(sftpPacket(byte(3), 1, "/tmp/app.conf", 0x1a, 0x04, 0640))
+	if typ != 102 {
+		t.Fatalf("expected a handle, got packet %d", typ)
+	}
+	handle := string(payload[8:])
+
+	if code := status(sftpPacket(byte(6), 2, handle, uint64(0), "port = 80\n")); code != 0 {
+		t.Fatalf("WRITE: status %d", code)
+	} else if code := status(sftpPacket(byte(4), 3, handle)); code != 0 {
+		t.Fatalf("CLOSE: status %d", code)
+	}
+
+	if content, err := os.ReadFile(server.Path("/tmp/app.conf")); err != nil {
+		t.Fatal(err)
+	} else if string(content) != "port = 80\n" {
+		t.Fatalf("wrote %q", content)
+	}
+
+	// ATTRS with SIZE first, then PERMISSIONS
+	if typ, payload := exchange(sftpPacket(byte(17), 4, "/tmp/app.conf")); typ != 105 {
+		t.Fatalf("expected attrs, got packet %d", typ)
+	} else if flags := binary.BigEndian.Uint32(payload[4:]); flags&0x05 != 0x05 {
+		t.Fatalf("attrs flags %x miss size and permissions", flags)
+	} else if size := binary.BigEndian.Uint64(payload[8:]); size != 10 {
+		t.Fatalf("attrs size %d", size)
+	}
+
+	if code := status(sftpPacket(byte(17), 5, "/missing")); code != 2 {
+		t.Fatalf("STAT of a missing file: status %d, want no such file", code)
+	}
+}
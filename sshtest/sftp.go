@@ -0,0 +1,628 @@
+package sshtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ootiny/x"
+)
+
+// SFTP protocol version 3 packet types
+// https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+const (
+	sftpPacketInit     = 1
+	sftpPacketVersion  = 2
+	sftpPacketOpen     = 3
+	sftpPacketClose    = 4
+	sftpPacketRead     = 5
+	sftpPacketWrite    = 6
+	sftpPacketLstat    = 7
+	sftpPacketFstat    = 8
+	sftpPacketSetstat  = 9
+	sftpPacketFsetstat = 10
+	sftpPacketOpendir  = 11
+	sftpPacketReaddir  = 12
+	sftpPacketRemove   = 13
+	sftpPacketMkdir    = 14
+	sftpPacketRmdir    = 15
+	sftpPacketRealpath = 16
+	sftpPacketStat     = 17
+	sftpPacketRename   = 18
+	sftpPacketReadlink = 19
+	sftpPacketSymlink  = 20
+	sftpPacketStatus   = 101
+	sftpPacketHandle   = 102
+	sftpPacketData     = 103
+	sftpPacketName     = 104
+	sftpPacketAttrs    = 105
+	sftpPacketExtended = 200
+)
+
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpStatusOK               = 0
+	sftpStatusEOF              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusFailure          = 4
+	sftpStatusBadMessage       = 5
+	sftpStatusOpUnsupported    = 8
+)
+
+const (
+	// sftpMaxPacket is the largest packet the server accepts
+	sftpMaxPacket = 256 * 1024
+	// sftpReaddirBatch is the number of names returned by one READDIR
+	sftpReaddirBatch = 64
+)
+
+// resolvePath returns the local path of remotePath below root, remote paths
+// can not leave root with ".."
+func resolvePath(root string, remotePath string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+remotePath)))
+}
+
+// sftpBuffer builds a response payload
+type sftpBuffer struct {
+	data []byte
+}
+
+func (b *sftpBuffer) byte(v byte) *sftpBuffer {
+	b.data = append(b.data, v)
+	return b
+}
+
+func (b *sftpBuffer) uint32(v uint32) *sftpBuffer {
+	b.data = binary.BigEndian.AppendUint32(b.data, v)
+	return b
+}
+
+func (b *sftpBuffer) uint64(v uint64) *sftpBuffer {
+	b.data = binary.BigEndian.AppendUint64(b.data, v)
+	return b
+}
+
+func (b *sftpBuffer) string(v string) *sftpBuffer {
+	b.uint32(uint32(len(v)))
+	b.data = append(b.data, v...)
+	return b
+}
+
+// attrs writes the attributes of info, files are reported as owned by
+// uid and gid 0
+func (b *sftpBuffer) attrs(info os.FileInfo) *sftpBuffer {
+	mtime := uint32(info.ModTime().Unix())
+	return b.uint32(sftpAttrSize | sftpAttrUIDGID | sftpAttrPermissions | sftpAttrACModTime).
+		uint64(uint64(info.Size())).
+		uint32(0).uint32(0).
+		uint32(sftpFromFileMode(info.Mode())).
+		uint32(mtime).uint32(mtime)
+}
+
+// sftpReader parses a request payload
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.data) < 8 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	n := r.uint32()
+	if r.err != nil {
+		return ""
+	} else if uint32(len(r.data)) < n {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	v := string(r.data[:n])
+	r.data = r.data[n:]
+	return v
+}
+
+// attrs reads the attributes of a request, only the permissions are used
+func (r *sftpReader) attrs() (uint32, bool) {
+	flags := r.uint32()
+	if flags&sftpAttrSize != 0 {
+		_ = r.uint64()
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		_, _ = r.uint32(), r.uint32()
+	}
+	permissions := uint32(0)
+	if flags&sftpAttrPermissions != 0 {
+		permissions = r.uint32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		_, _ = r.uint32(), r.uint32()
+	}
+	if flags&sftpAttrExtended != 0 {
+		for range r.uint32() {
+			_, _ = r.string(), r.string()
+		}
+	}
+	return permissions, flags&sftpAttrPermissions != 0
+}
+
+// sftpFromFileMode converts an os.FileMode into posix st_mode bits
+func sftpFromFileMode(mode os.FileMode) uint32 {
+	ret := uint32(mode.Perm())
+
+	switch {
+	case mode.IsDir():
+		ret |= 0040000
+	case mode&os.ModeSymlink != 0:
+		ret |= 0120000
+	case mode&os.ModeNamedPipe != 0:
+		ret |= 0010000
+	case mode&os.ModeSocket != 0:
+		ret |= 0140000
+	case mode&os.ModeCharDevice != 0:
+		ret |= 0020000
+	case mode&os.ModeDevice != 0:
+		ret |= 0060000
+	default:
+		ret |= 0100000
+	}
+
+	if mode&os.ModeSetuid != 0 {
+		ret |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		ret |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		ret |= 01000
+	}
+
+	return ret
+}
+
+// sftpServer serves the sftp subsystem of one session, remote paths are
+// resolved below root. Ownership changes are accepted and ignored.
+type sftpServer struct {
+	root    string
+	channel io.ReadWriter
+	files   map[string]*os.File
+	dirs    map[string][]os.FileInfo
+	handles int
+}
+
+// serveSFTP serves the sftp subsystem on channel until the client closes
+// it and returns the exit status of the subsystem
+func serveSFTP(root string, channel io.ReadWriter) int {
+	server := &sftpServer{
+		root:    root,
+		channel: channel,
+		files:   map[string]*os.File{},
+		dirs:    map[string][]os.FileInfo{},
+	}
+	defer server.closeAll()
+
+	for {
+		typ, payload, err := server.readPacket()
+		if err == io.EOF {
+			return 0
+		} else if err != nil {
+			return 1
+		} else if err := server.handle(typ, payload); err != nil {
+			return 1
+		} else {
+			x.Ignore()
+		}
+	}
+}
+
+func (p *sftpServer) closeAll() {
+	for _, file := range p.files {
+		_ = file.Close()
+	}
+}
+
+func (p *sftpServer) readPacket() (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(p.channel, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > sftpMaxPacket {
+		return 0, nil, x.Errorf("invalid sftp packet length %d", length)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(p.channel, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+func (p *sftpServer) send(b *sftpBuffer) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(b.data)))
+	_, err := p.channel.Write(append(packet, b.data...))
+	return err
+}
+
+// status answers request id with the status of err, local paths below
+// root are left out of the message
+func (p *sftpServer) status(id uint32, err error) error {
+	message := ""
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) {
+		message = pathErr.Err.Error()
+	} else if errors.As(err, &linkErr) {
+		message = linkErr.Err.Error()
+	} else if err != nil {
+		message = err.Error()
+	} else {
+		x.Ignore()
+	}
+
+	code := uint32(sftpStatusOK)
+	if err == nil {
+		message = "Success"
+	} else if errors.Is(err, io.EOF) {
+		code, message = sftpStatusEOF, "End of file"
+	} else if errors.Is(err, os.ErrNotExist) {
+		code = sftpStatusNoSuchFile
+	} else if errors.Is(err, os.ErrPermission) {
+		code = sftpStatusPermissionDenied
+	} else {
+		code = sftpStatusFailure
+	}
+
+	return p.send((&sftpBuffer{}).byte(sftpPacketStatus).uint32(id).uint32(code).string(message).string(""))
+}
+
+func (p *sftpServer) unsupported(id uint32) error {
+	return p.send(
+		(&sftpBuffer{}).byte(sftpPacketStatus).uint32(id).
+			uint32(sftpStatusOpUnsupported).string("Operation unsupported").string(""),
+	)
+}
+
+func (p *sftpServer) handle(typ byte, payload []byte) error {
+	if typ == sftpPacketInit {
+		return p.send((&sftpBuffer{}).byte(sftpPacketVersion).uint32(3))
+	}
+
+	r := &sftpReader{data: payload}
+	id := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+
+	var answer func() error
+	switch typ {
+	case sftpPacketOpen:
+		answer = p.open(id, r)
+	case sftpPacketClose:
+		answer = p.close(id, r)
+	case sftpPacketRead:
+		answer = p.read(id, r)
+	case sftpPacketWrite:
+		answer = p.write(id, r)
+	case sftpPacketLstat, sftpPacketStat, sftpPacketFstat:
+		answer = p.stat(typ, id, r)
+	case sftpPacketSetstat, sftpPacketFsetstat:
+		answer = p.setstat(typ, id, r)
+	case sftpPacketOpendir:
+		answer = p.opendir(id, r)
+	case sftpPacketReaddir:
+		answer = p.readdir(id, r)
+	case sftpPacketRemove:
+		filePath := p.resolve(r.string())
+		answer = func() error { return p.status(id, os.Remove(filePath)) }
+	case sftpPacketMkdir:
+		dirPath := p.resolve(r.string())
+		mode, ok := r.attrs()
+		answer = func() error {
+			return p.status(id, os.Mkdir(dirPath, os.FileMode(x.Ternary(ok, mode, 0755)).Perm()))
+		}
+	case sftpPacketRmdir:
+		answer = p.rmdir(id, r)
+	case sftpPacketRealpath:
+		remotePath := path.Clean("/" + r.string())
+		answer = func() error { return p.name(id, remotePath) }
+	case sftpPacketRename:
+		answer = p.rename(id, r, false)
+	case sftpPacketReadlink:
+		linkPath := p.resolve(r.string())
+		answer = func() error {
+			target, err := os.Readlink(linkPath)
+			if err != nil {
+				return p.status(id, err)
+			}
+			return p.name(id, target)
+		}
+	case sftpPacketSymlink:
+		// OpenSSH sends the target first, then the path of the link
+		target, linkPath := r.string(), p.resolve(r.string())
+		answer = func() error { return p.status(id, os.Symlink(target, linkPath)) }
+	case sftpPacketExtended:
+		if r.string() == "posix-rename@openssh.com" {
+			answer = p.rename(id, r, true)
+		} else {
+			answer = func() error { return p.unsupported(id) }
+		}
+	default:
+		answer = func() error { return p.unsupported(id) }
+	}
+
+	if r.err != nil {
+		return p.send(
+			(&sftpBuffer{}).byte(sftpPacketStatus).uint32(id).
+				uint32(sftpStatusBadMessage).string("Bad message").string(""),
+		)
+	}
+	return answer()
+}
+
+func (p *sftpServer) resolve(remotePath string) string {
+	return resolvePath(p.root, remotePath)
+}
+
+// newHandle returns an unused handle with prefix
+func (p *sftpServer) newHandle(prefix string) string {
+	p.handles++
+	return prefix + strconv.Itoa(p.handles)
+}
+
+func (p *sftpServer) sendHandle(id uint32, handle string) error {
+	return p.send((&sftpBuffer{}).byte(sftpPacketHandle).uint32(id).string(handle))
+}
+
+// name answers request id with a single name
+func (p *sftpServer) name(id uint32, name string) error {
+	return p.send(
+		(&sftpBuffer{}).byte(sftpPacketName).uint32(id).uint32(1).
+			string(name).string(name).uint32(0),
+	)
+}
+
+func (p *sftpServer) open(id uint32, r *sftpReader) func() error {
+	filePath, flags := p.resolve(r.string()), r.uint32()
+	mode, ok := r.attrs()
+
+	return func() error {
+		openFlags := os.O_RDONLY
+		if flags&sftpFlagRead != 0 && flags&sftpFlagWrite != 0 {
+			openFlags = os.O_RDWR
+		} else if flags&sftpFlagWrite != 0 {
+			openFlags = os.O_WRONLY
+		} else {
+			x.Ignore()
+		}
+
+		if flags&sftpFlagAppend != 0 {
+			openFlags |= os.O_APPEND
+		}
+		if flags&sftpFlagCreate != 0 {
+			openFlags |= os.O_CREATE
+		}
+		if flags&sftpFlagTrunc != 0 {
+			openFlags |= os.O_TRUNC
+		}
+		if flags&sftpFlagExcl != 0 {
+			openFlags |= os.O_EXCL
+		}
+
+		file, err := os.OpenFile(filePath, openFlags, os.FileMode(x.Ternary(ok, mode, 0644)).Perm())
+		if err != nil {
+			return p.status(id, err)
+		}
+
+		handle := p.newHandle("f")
+		p.files[handle] = file
+		return p.sendHandle(id, handle)
+	}
+}
+
+func (p *sftpServer) close(id uint32, r *sftpReader) func() error {
+	handle := r.string()
+
+	return func() error {
+		if file, ok := p.files[handle]; ok {
+			delete(p.files, handle)
+			return p.status(id, file.Close())
+		} else if _, ok := p.dirs[handle]; ok {
+			delete(p.dirs, handle)
+			return p.status(id, nil)
+		} else {
+			return p.status(id, x.Errorf("invalid handle"))
+		}
+	}
+}
+
+func (p *sftpServer) read(id uint32, r *sftpReader) func() error {
+	handle, offset, length := r.string(), r.uint64(), r.uint32()
+
+	return func() error {
+		file, ok := p.files[handle]
+		if !ok {
+			return p.status(id, x.Errorf("invalid handle"))
+		}
+
+		buf := make([]byte, min(length, sftpMaxPacket-64))
+		n, err := file.ReadAt(buf, int64(offset))
+		if n == 0 {
+			return p.status(id, x.Ternary(err == nil, io.EOF, err))
+		}
+
+		b := (&sftpBuffer{}).byte(sftpPacketData).uint32(id).uint32(uint32(n))
+		b.data = append(b.data, buf[:n]...)
+		return p.send(b)
+	}
+}
+
+func (p *sftpServer) write(id uint32, r *sftpReader) func() error {
+	handle, offset, data := r.string(), r.uint64(), r.string()
+
+	return func() error {
+		file, ok := p.files[handle]
+		if !ok {
+			return p.status(id, x.Errorf("invalid handle"))
+		}
+
+		_, err := file.WriteAt([]byte(data), int64(offset))
+		return p.status(id, err)
+	}
+}
+
+func (p *sftpServer) stat(typ byte, id uint32, r *sftpReader) func() error {
+	target := r.string()
+
+	return func() error {
+		var info os.FileInfo
+		var err error
+		if typ == sftpPacketFstat {
+			if file, ok := p.files[target]; ok {
+				info, err = file.Stat()
+			} else {
+				err = x.Errorf("invalid handle")
+			}
+		} else if typ == sftpPacketLstat {
+			info, err = os.Lstat(p.resolve(target))
+		} else {
+			info, err = os.Stat(p.resolve(target))
+		}
+
+		if err != nil {
+			return p.status(id, err)
+		}
+		return p.send((&sftpBuffer{}).byte(sftpPacketAttrs).uint32(id).attrs(info))
+	}
+}
+
+func (p *sftpServer) setstat(typ byte, id uint32, r *sftpReader) func() error {
+	target := r.string()
+	mode, ok := r.attrs()
+
+	return func() error {
+		filePath := ""
+		if typ == sftpPacketFsetstat {
+			file, found := p.files[target]
+			if !found {
+				return p.status(id, x.Errorf("invalid handle"))
+			}
+			filePath = file.Name()
+		} else {
+			filePath = p.resolve(target)
+		}
+
+		if !ok {
+			_, err := os.Lstat(filePath)
+			return p.status(id, err)
+		}
+		return p.status(id, os.Chmod(filePath, os.FileMode(mode&0777)))
+	}
+}
+
+func (p *sftpServer) opendir(id uint32, r *sftpReader) func() error {
+	dirPath := p.resolve(r.string())
+
+	return func() error {
+		entries, err := os.ReadDir(dirPath)
+		if err != nil {
+			return p.status(id, err)
+		}
+
+		infos := []os.FileInfo{}
+		for _, entry := range entries {
+			if info, err := os.Lstat(filepath.Join(dirPath, entry.Name())); err == nil {
+				infos = append(infos, info)
+			}
+		}
+
+		handle := p.newHandle("d")
+		p.dirs[handle] = infos
+		return p.sendHandle(id, handle)
+	}
+}
+
+func (p *sftpServer) readdir(id uint32, r *sftpReader) func() error {
+	handle := r.string()
+
+	return func() error {
+		infos, ok := p.dirs[handle]
+		if !ok {
+			return p.status(id, x.Errorf("invalid handle"))
+		} else if len(infos) == 0 {
+			return p.status(id, io.EOF)
+		}
+
+		n := min(len(infos), sftpReaddirBatch)
+		b := (&sftpBuffer{}).byte(sftpPacketName).uint32(id).uint32(uint32(n))
+		for _, info := range infos[:n] {
+			b.string(info.Name()).string(info.Name()).attrs(info)
+		}
+		p.dirs[handle] = infos[n:]
+		return p.send(b)
+	}
+}
+
+func (p *sftpServer) rmdir(id uint32, r *sftpReader) func() error {
+	dirPath := p.resolve(r.string())
+
+	return func() error {
+		if info, err := os.Lstat(dirPath); err != nil {
+			return p.status(id, err)
+		} else if !info.IsDir() {
+			return p.status(id, x.Errorf("%s is not a directory", info.Name()))
+		} else {
+			return p.status(id, os.Remove(dirPath))
+		}
+	}
+}
+
+// rename renames a file, only posix renames replace an existing target
+func (p *sftpServer) rename(id uint32, r *sftpReader, posix bool) func() error {
+	oldPath, newPath := p.resolve(r.string()), p.resolve(r.string())
+
+	return func() error {
+		if _, err := os.Lstat(newPath); err == nil && !posix {
+			return p.status(id, os.ErrExist)
+		}
+		return p.status(id, os.Rename(oldPath, newPath))
+	}
+}